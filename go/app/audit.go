@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Operations recorded in the audit log.
+const (
+	auditCreate      = "create"
+	auditUpdate      = "update"
+	auditDelete      = "delete"
+	auditRestore     = "restore"
+	auditAddImage    = "add_image"
+	auditDeleteImage = "delete_image"
+)
+
+// AuditEntry records one change to an item. Entries outlive the item, so
+// the history of a deleted item can still be read.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	ItemID    int64     `json:"item_id"`
+	Operation string    `json:"operation"`
+	Actor     string    `json:"actor,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditLog struct {
+	Entries []*AuditEntry `json:"entries"`
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// recordAudit adds an entry to the audit log. It is called in the
+// transaction making the change, so that neither is stored without the
+// other. actor is "" when the write needed no credentials.
+func recordAudit(ctx context.Context, e execer, itemID int64, operation, actor string) error {
+	_, err := e.ExecContext(ctx, "INSERT INTO audit_log (item_id, operation, actor) VALUES (?, ?, ?)",
+		itemID, operation, sql.NullString{String: actor, Valid: actor != ""})
+	return err
+}
+
+// selectAuditLog returns the audit log of the item, oldest first.
+func selectAuditLog(ctx context.Context, db *sql.DB, itemID int64) ([]*AuditEntry, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, item_id, operation, actor, created_at FROM audit_log WHERE item_id = ? ORDER BY id", itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var (
+			entry     AuditEntry
+			actor     sql.NullString
+			createdAt string
+		)
+		if err := rows.Scan(&entry.ID, &entry.ItemID, &entry.Operation, &actor, &createdAt); err != nil {
+			return nil, err
+		}
+		entry.Actor = actor.String
+		if entry.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *Server) getAuditLog(c echo.Context) error {
+	value := c.QueryParam("item_id")
+	if value == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, "item_id is required", nil)
+	}
+	itemID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, "item_id must be an integer", nil)
+	}
+
+	entries, err := selectAuditLog(c.Request().Context(), s.db, itemID)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select audit log", err)
+	}
+	return c.JSON(http.StatusOK, AuditLog{Entries: entries})
+}
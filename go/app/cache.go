@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxCachedResponses caps the entries of a responseCache. Once it is full
+// the cache starts over, which is simpler than evicting and rare enough,
+// as most clients ask for the same few pages.
+const maxCachedResponses = 256
+
+// responseCache keeps the bodies of GET /items responses until the next
+// write request. A response being computed while a write happens is not
+// cached, as it may predate the write.
+type responseCache struct {
+	mu      sync.Mutex
+	gen     uint64
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+}
+
+// get returns the response cached under key, and the generation to store
+// a response computed instead with.
+func (rc *responseCache) get(key string) (res cachedResponse, gen uint64, ok bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	res, ok = rc.entries[key]
+	return res, rc.gen, ok
+}
+
+// put caches res under key unless there was a write since gen.
+func (rc *responseCache) put(key string, gen uint64, res cachedResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if gen != rc.gen {
+		return
+	}
+	if rc.entries == nil || len(rc.entries) >= maxCachedResponses {
+		rc.entries = make(map[string]cachedResponse)
+	}
+	rc.entries[key] = res
+}
+
+// invalidate drops every cached response.
+func (rc *responseCache) invalidate() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.gen++
+	rc.entries = nil
+}
+
+// serve answers with the response cached under key or, failing that, lets
+// write answer and caches what it wrote if it was a 200.
+func (rc *responseCache) serve(c echo.Context, key string, write func() error) error {
+	res, gen, ok := rc.get(key)
+	if ok {
+		return c.Blob(http.StatusOK, res.contentType, res.body)
+	}
+
+	w := c.Response().Writer
+	rec := &bodyRecorder{ResponseWriter: w}
+	c.Response().Writer = rec
+	err := write()
+	c.Response().Writer = w
+	if err == nil && c.Response().Status == http.StatusOK {
+		rc.put(key, gen, cachedResponse{
+			contentType: c.Response().Header().Get(echo.HeaderContentType),
+			body:        rec.body.Bytes(),
+		})
+	}
+	return err
+}
+
+// bodyRecorder copies the body written through it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
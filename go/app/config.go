@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/gommon/bytes"
+	"github.com/labstack/gommon/log"
+)
+
+// Config holds the settings read from the environment at startup.
+type Config struct {
+	// Addr is the address to listen on, from HOST and PORT. Default ":9000".
+	Addr string
+	// ImgDir is the directory uploaded images are stored in and served from.
+	ImgDir string
+	// DBPath is the SQLite database file.
+	DBPath string
+	// StorageBackend is where items are stored: storageSQLite, the
+	// default, or storageJSON, which keeps them in ItemsJSON and serves
+	// only the core item routes.
+	StorageBackend string
+	// ItemsJSON is the legacy items.json file imported on first boot, or
+	// the file items are stored in by the json backend.
+	ItemsJSON string
+	// StrictData makes a corrupt ItemsJSON stop the server from starting.
+	// Otherwise it is set aside and the server starts without its items.
+	// Default true.
+	StrictData bool
+	// FrontURLs are the origins allowed by CORS, from the comma-separated
+	// FRONT_URLS or else the single FRONT_URL.
+	FrontURLs []string
+	// CORSAllowCredentials lets browsers send cookies and authorization
+	// headers cross-origin.
+	CORSAllowCredentials bool
+	// CORSAllowHeaders are the request headers allowed cross-origin, from
+	// the comma-separated CORS_ALLOW_HEADERS. Default Accept,
+	// Accept-Language, Authorization, Content-Type and Idempotency-Key.
+	CORSAllowHeaders []string
+	// CORSExposeHeaders are the response headers scripts may read
+	// cross-origin, from the comma-separated CORS_EXPOSE_HEADERS. Default
+	// Location and ETag.
+	CORSExposeHeaders []string
+	// CORSMaxAge is how long browsers may cache the result of a preflight
+	// request; 0 leaves it to them. Default 10m.
+	CORSMaxAge time.Duration
+	// ImageQuality, from 1 to 100, is the JPEG quality uploaded PNGs and
+	// WebPs are converted with and thumbnails are encoded with, from
+	// IMAGE_QUALITY or else the older JPEG_QUALITY. Thumbnails already
+	// cached keep their quality. Default 85.
+	ImageQuality int
+	// MinImageWidth and MinImageHeight are the smallest, and MaxImageWidth
+	// and MaxImageHeight the largest, dimensions in pixels of an uploaded
+	// image. Defaults 16 and 4000.
+	MinImageWidth  int
+	MinImageHeight int
+	MaxImageWidth  int
+	MaxImageHeight int
+	// MaxUploadSize caps the size of a request body, e.g. "5M".
+	MaxUploadSize string
+	// MaxImageSize caps the size in bytes of each uploaded image, from
+	// MAX_IMAGE_SIZE, e.g. "2M". It matters when one request uploads
+	// several images. Default MaxUploadSize.
+	MaxImageSize int64
+	// WriteRateLimit is the number of write requests per second allowed
+	// from one client, with bursts of up to WriteRateBurst.
+	WriteRateLimit float64
+	WriteRateBurst int
+	// TrustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For header gives the client address, from
+	// TRUSTED_PROXIES, e.g. "10.0.0.0/8,192.168.1.1/32". The rate limit
+	// goes by that address. Default none, so the header is ignored and the
+	// address of the connection is used.
+	TrustedProxies []*net.IPNet
+	// RequestTimeout cancels the context of a request running longer,
+	// which stops its database queries and thumbnail, and the request is
+	// answered with 503. Images other than thumbnails, the CSV export and
+	// the streams of events are exempt. 0 disables it. Default 30s.
+	RequestTimeout time.Duration
+
+	// AdminUser and AdminPass are the HTTP basic auth credentials required
+	// by the routes that modify items. Reads stay public. When neither
+	// they nor JWTSecret are set, the write routes are open too.
+	AdminUser string
+	AdminPass string
+	// JWTSecret signs the tokens issued by POST /login. When set, the
+	// routes that modify items also accept a bearer token, and items can
+	// only be changed by the user who added them. Basic auth as AdminUser
+	// may still change any item.
+	JWTSecret string
+
+	// DBMaxOpenConns limits the connections to the database. WAL mode lets
+	// readers proceed alongside the single writer, so a few connections
+	// are useful, but each holds its own page cache. Default 8.
+	DBMaxOpenConns int
+	// DBMaxIdleConns is the number of connections kept open between
+	// requests. It defaults to DBMaxOpenConns so connections are reused
+	// rather than reopened.
+	DBMaxIdleConns int
+	// DBConnMaxLifetime recycles connections after this long; 0 keeps them
+	// forever. Default 1h.
+	DBConnMaxLifetime time.Duration
+	// DBMaxRetries is how many times a write that finds the database busy
+	// is retried, waiting DBRetryDelay at first and twice as long after
+	// each attempt. Defaults 3 and 10ms.
+	DBMaxRetries int
+	DBRetryDelay time.Duration
+	// ItemDedup is what POST /items does with an item of the same name
+	// and category as an existing one: dedupAllow adds it anyway,
+	// dedupReject answers 409 and dedupReturn answers with the existing
+	// item. Default dedupAllow.
+	ItemDedup string
+	// RequireUniqueNames rejects items named like another item with 409.
+	// Default false.
+	RequireUniqueNames bool
+	// DefaultCategory is the category POST /items puts items in that have
+	// none. Like any category it is looked up, and created if needed, by
+	// its exact name, so renaming its category with PUT /categories/:id
+	// makes later items start a new category of the old name. "", the
+	// default, keeps category required.
+	DefaultCategory string
+	// MaxItems caps the number of items not deleted; POST /items answers
+	// 403 once it is reached, and bulk inserts and imports that would
+	// exceed it are rejected whole. Restoring items is not limited. 0, the
+	// default, is no limit.
+	MaxItems int
+	// SoftDelete makes DELETE /items/:id hide items rather than remove
+	// them, so they can be restored. Default true; the json backend always
+	// removes them.
+	SoftDelete bool
+	// ReadOnly starts the server in maintenance mode, answering every write
+	// request with 503 while reads keep working. When ADMIN_USER is set,
+	// the admin can toggle it at run time with PUT /maintenance. Default
+	// false.
+	ReadOnly bool
+	// LogLevel is the minimum level logged, from LOG_LEVEL: debug, info,
+	// warn or error. Default info, which is also used for unknown values.
+	LogLevel log.Lvl
+	// VacuumInterval is how often space freed by deletes is reclaimed; 0
+	// disables it. Default 24h.
+	VacuumInterval time.Duration
+}
+
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		ImgDir:        getEnv("IMG_DIR", "images"),
+		DBPath:        getEnv("ITEMS_DB", "../db/mercari.sqlite3"),
+		ItemsJSON:     getEnv("ITEMS_JSON", "./items.json"),
+		MaxUploadSize: getEnv("MAX_UPLOAD_SIZE", "5M"),
+		AdminUser:     os.Getenv("ADMIN_USER"),
+		AdminPass:     os.Getenv("ADMIN_PASS"),
+		JWTSecret:     os.Getenv("JWT_SECRET"),
+	}
+	if (cfg.AdminUser == "") != (cfg.AdminPass == "") {
+		return nil, fmt.Errorf("ADMIN_USER and ADMIN_PASS must be set together")
+	}
+
+	port, err := getEnvInt("PORT", 9000)
+	if err != nil {
+		return nil, err
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("PORT: %d is not a valid port", port)
+	}
+	cfg.Addr = net.JoinHostPort(os.Getenv("HOST"), strconv.Itoa(port))
+
+	if _, err := bytes.Parse(cfg.MaxUploadSize); err != nil {
+		return nil, fmt.Errorf("MAX_UPLOAD_SIZE: %w", err)
+	}
+	if cfg.MaxImageSize, err = bytes.Parse(getEnv("MAX_IMAGE_SIZE", cfg.MaxUploadSize)); err != nil {
+		return nil, fmt.Errorf("MAX_IMAGE_SIZE: %w", err)
+	}
+
+	cfg.FrontURLs = splitList(getEnv("FRONT_URLS", getEnv("FRONT_URL", "http://localhost:3000")))
+	if len(cfg.FrontURLs) == 0 {
+		return nil, fmt.Errorf("FRONT_URLS: no origins")
+	}
+
+	qualityKey := "IMAGE_QUALITY"
+	if os.Getenv(qualityKey) == "" && os.Getenv("JPEG_QUALITY") != "" {
+		qualityKey = "JPEG_QUALITY"
+	}
+	if cfg.ImageQuality, err = getEnvInt(qualityKey, 85); err != nil {
+		return nil, err
+	}
+	if cfg.ImageQuality < 1 || cfg.ImageQuality > 100 {
+		return nil, fmt.Errorf("%s: %d is not between 1 and 100", qualityKey, cfg.ImageQuality)
+	}
+
+	if cfg.MinImageWidth, err = getEnvInt("MIN_IMAGE_WIDTH", 16); err != nil {
+		return nil, err
+	}
+	if cfg.MinImageHeight, err = getEnvInt("MIN_IMAGE_HEIGHT", 16); err != nil {
+		return nil, err
+	}
+	if cfg.MaxImageWidth, err = getEnvInt("MAX_IMAGE_WIDTH", 4000); err != nil {
+		return nil, err
+	}
+	if cfg.MaxImageHeight, err = getEnvInt("MAX_IMAGE_HEIGHT", 4000); err != nil {
+		return nil, err
+	}
+	if cfg.MinImageWidth < 1 || cfg.MinImageWidth > cfg.MaxImageWidth {
+		return nil, fmt.Errorf("MIN_IMAGE_WIDTH: %d is not between 1 and MAX_IMAGE_WIDTH (%d)", cfg.MinImageWidth, cfg.MaxImageWidth)
+	}
+	if cfg.MinImageHeight < 1 || cfg.MinImageHeight > cfg.MaxImageHeight {
+		return nil, fmt.Errorf("MIN_IMAGE_HEIGHT: %d is not between 1 and MAX_IMAGE_HEIGHT (%d)", cfg.MinImageHeight, cfg.MaxImageHeight)
+	}
+
+	if cfg.CORSAllowCredentials, err = getEnvBool("CORS_ALLOW_CREDENTIALS", false); err != nil {
+		return nil, err
+	}
+	cfg.CORSAllowHeaders = splitList(getEnv("CORS_ALLOW_HEADERS", "Accept,Accept-Language,Authorization,Content-Type,Idempotency-Key"))
+	cfg.CORSExposeHeaders = splitList(getEnv("CORS_EXPOSE_HEADERS", "Location,ETag"))
+	if cfg.CORSMaxAge, err = getEnvDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.CORSMaxAge < 0 {
+		return nil, fmt.Errorf("CORS_MAX_AGE: %s is negative", cfg.CORSMaxAge)
+	}
+	if cfg.WriteRateLimit, err = getEnvFloat("RATE_LIMIT", 5); err != nil {
+		return nil, err
+	}
+	if cfg.WriteRateBurst, err = getEnvInt("RATE_BURST", 10); err != nil {
+		return nil, err
+	}
+	for _, cidr := range splitList(os.Getenv("TRUSTED_PROXIES")) {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not a CIDR", cidr)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, ipNet)
+	}
+	if cfg.RequestTimeout, err = getEnvDuration("REQUEST_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxOpenConns, err = getEnvInt("DB_MAX_OPEN_CONNS", 8); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxIdleConns, err = getEnvInt("DB_MAX_IDLE_CONNS", cfg.DBMaxOpenConns); err != nil {
+		return nil, err
+	}
+	if cfg.DBConnMaxLifetime, err = getEnvDuration("DB_CONN_MAX_LIFETIME", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxRetries, err = getEnvInt("DB_MAX_RETRIES", 3); err != nil {
+		return nil, err
+	}
+	if cfg.DBRetryDelay, err = getEnvDuration("DB_RETRY_DELAY", 10*time.Millisecond); err != nil {
+		return nil, err
+	}
+	switch cfg.StorageBackend = getEnv("STORAGE_BACKEND", storageSQLite); cfg.StorageBackend {
+	case storageSQLite, storageJSON:
+	default:
+		return nil, fmt.Errorf("STORAGE_BACKEND: %q is not %s or %s", cfg.StorageBackend, storageSQLite, storageJSON)
+	}
+	switch cfg.ItemDedup = getEnv("ITEM_DEDUP", dedupAllow); cfg.ItemDedup {
+	case dedupAllow, dedupReject, dedupReturn:
+	default:
+		return nil, fmt.Errorf("ITEM_DEDUP: %q is not one of %s, %s or %s", cfg.ItemDedup, dedupAllow, dedupReject, dedupReturn)
+	}
+	if cfg.StrictData, err = getEnvBool("STRICT_DATA", true); err != nil {
+		return nil, err
+	}
+	// Cleaned up like the category of a request, so it names the same
+	// category as a client sending it would.
+	cfg.DefaultCategory = sanitizeName(getEnv("DEFAULT_CATEGORY", ""))
+	if n := utf8.RuneCountInString(cfg.DefaultCategory); n > maxNameLength {
+		return nil, fmt.Errorf("DEFAULT_CATEGORY: %d characters is longer than %d", n, maxNameLength)
+	}
+	if cfg.MaxItems, err = getEnvInt("MAX_ITEMS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxItems < 0 {
+		return nil, fmt.Errorf("MAX_ITEMS: %d is negative", cfg.MaxItems)
+	}
+	if cfg.SoftDelete, err = getEnvBool("SOFT_DELETE", true); err != nil {
+		return nil, err
+	}
+	if cfg.RequireUniqueNames, err = getEnvBool("REQUIRE_UNIQUE_NAMES", false); err != nil {
+		return nil, err
+	}
+	if cfg.ReadOnly, err = getEnvBool("READ_ONLY", false); err != nil {
+		return nil, err
+	}
+	cfg.LogLevel, _ = parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if cfg.VacuumInterval, err = getEnvDuration("VACUUM_INTERVAL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Values of Config.ItemDedup.
+const (
+	dedupAllow  = "allow"
+	dedupReject = "reject"
+	dedupReturn = "return"
+)
+
+// parseLogLevel returns the log level named by value, ignoring case. ok
+// is false, and the level log.INFO, if value is empty or unknown.
+func parseLogLevel(value string) (lvl log.Lvl, ok bool) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return log.DEBUG, true
+	case "info":
+		return log.INFO, true
+	case "warn", "warning":
+		return log.WARN, true
+	case "error":
+		return log.ERROR, true
+	}
+	return log.INFO, false
+}
+
+// getEnv returns the value of the environment variable key, or def when it
+// is unset or empty.
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getEnvInt is like getEnv for integer values.
+func getEnvInt(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not an integer", key, value)
+	}
+	return n, nil
+}
+
+// getEnvBool is like getEnv for strconv.ParseBool values such as "true".
+func getEnvBool(key string, def bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not a boolean", key, value)
+	}
+	return b, nil
+}
+
+// splitList splits a comma-separated value, dropping blank entries.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// getEnvFloat is like getEnv for numeric values.
+func getEnvFloat(key string, def float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not a number", key, value)
+	}
+	return f, nil
+}
+
+// getEnvDuration is like getEnv for time.ParseDuration values such as "30s".
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not a duration", key, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,1230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/mattn/go-sqlite3"
+)
+
+// migrations are applied in order on startup. The number of applied
+// migrations is kept in PRAGMA user_version, so append new entries
+// instead of editing existing ones.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		category TEXT NOT NULL,
+		image_name TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+	INSERT INTO categories (name) SELECT DISTINCT category FROM items;
+	CREATE TABLE items_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		category_id INTEGER NOT NULL REFERENCES categories (id),
+		image_name TEXT NOT NULL DEFAULT ''
+	);
+	INSERT INTO items_new (id, name, category_id, image_name)
+		SELECT items.id, items.name, categories.id, items.image_name
+		FROM items JOIN categories ON categories.name = items.category;
+	DROP TABLE items;
+	ALTER TABLE items_new RENAME TO items;`,
+	`ALTER TABLE items ADD COLUMN price INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE items ADD COLUMN description TEXT NOT NULL DEFAULT '';`,
+	// ADD COLUMN cannot default to the current time, so rebuild the table.
+	// Existing items are stamped with the time of the migration.
+	`CREATE TABLE items_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		category_id INTEGER NOT NULL REFERENCES categories (id),
+		image_name TEXT NOT NULL DEFAULT '',
+		price INTEGER NOT NULL DEFAULT 0,
+		description TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+	);
+	INSERT INTO items_new (id, name, category_id, image_name, price, description)
+		SELECT id, name, category_id, image_name, price, description FROM items;
+	DROP TABLE items;
+	ALTER TABLE items_new RENAME TO items;
+	CREATE INDEX items_created_at ON items (created_at);`,
+	`CREATE TABLE idempotency_keys (
+		key TEXT PRIMARY KEY,
+		item_id INTEGER NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+	);
+	CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at);`,
+	`ALTER TABLE items ADD COLUMN deleted_at TEXT;`,
+	`ALTER TABLE items ADD COLUMN owner_id TEXT;`,
+	`CREATE INDEX items_name_category ON items (name, category_id);`,
+	`ALTER TABLE items ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+	`CREATE TABLE item_images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL REFERENCES items (id),
+		image_name TEXT NOT NULL,
+		UNIQUE (item_id, image_name)
+	);
+	CREATE INDEX item_images_image_name ON item_images (image_name);`,
+	`CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		operation TEXT NOT NULL,
+		actor TEXT,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+	);
+	CREATE INDEX audit_log_item_id ON audit_log (item_id);`,
+	`ALTER TABLE items ADD COLUMN alt_text TEXT NOT NULL DEFAULT '';
+	UPDATE items SET alt_text = name;`,
+	`ALTER TABLE item_images ADD COLUMN alt_text TEXT NOT NULL DEFAULT '';
+	UPDATE item_images SET alt_text = (SELECT name FROM items WHERE items.id = item_images.item_id);`,
+}
+
+// timeFormat is the format of timestamps stored by SQLite's
+// strftime('%Y-%m-%dT%H:%M:%fZ'). It sorts as text in time order.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// parseTime parses a timestamp stored in timeFormat.
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// itemsMu serializes writers to the items table; SQLite only allows one at a
+// time and would otherwise fail concurrent writes with "database is locked".
+// Readers take the read lock so they never observe a write in progress.
+var itemsMu sync.RWMutex
+
+// itemsFrom joins each item with its category so queries can filter and
+// report by category name.
+const itemsFrom = ` FROM items JOIN categories ON categories.id = items.category_id`
+
+// selectItemsQuery selects the columns scanned by scanItem. The extra
+// images of each item and their alt texts are concatenated in the order
+// they were added. Alt texts may contain commas but no control
+// characters, so they are separated by altTextSep.
+const selectItemsQuery = `SELECT items.id, items.name, categories.name, items.image_name, items.alt_text,
+	items.price, items.description, items.created_at, items.deleted_at, items.owner_id, items.version,
+	(SELECT group_concat(image_name) FROM (SELECT image_name FROM item_images WHERE item_id = items.id ORDER BY id)),
+	(SELECT group_concat(alt_text, char(31)) FROM (SELECT alt_text FROM item_images WHERE item_id = items.id ORDER BY id))` + itemsFrom
+
+// notDeleted is the condition excluding soft-deleted items.
+const notDeleted = "items.deleted_at IS NULL"
+
+// openDB opens the SQLite database at cfg.DBPath and brings its schema up
+// to date. On first boot any items found in cfg.ItemsJSON are imported once.
+func openDB(cfg *Config) (*sql.DB, error) {
+	// Every connection is opened in WAL mode so readers do not block the
+	// writer, and waits for a lock rather than failing immediately.
+	db, err := sql.Open("sqlite3", "file:"+cfg.DBPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	// Read items.json before migrating: once the schema exists it is never
+	// imported, so a failure afterwards would lose its items for good.
+	var legacy []*Item
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version == 0 {
+		if legacy, err = readItemsJSON(cfg); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate %s: %w", cfg.DBPath, err)
+	}
+	if err := setupFTS(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("set up full-text search: %w", err)
+	}
+	if err := setupUniqueNames(db, cfg.RequireUniqueNames); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if len(legacy) > 0 {
+		if err := insertItems(context.Background(), db, legacy, "", 0); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("import %s: %w", cfg.ItemsJSON, err)
+		}
+	}
+	return db, nil
+}
+
+// migrate applies pending migrations.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// PRAGMA does not accept placeholders.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readItemsJSON returns the items stored in the legacy items.json file. A
+// missing file has no items. A corrupt one is an error unless
+// cfg.StrictData is false, in which case it is renamed with a .bak suffix,
+// so that it is not lost, and has no items either.
+func readItemsJSON(cfg *Config) ([]*Item, error) {
+	data, err := os.ReadFile(cfg.ItemsJSON)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := parseItemsJSON(data)
+	if err == nil {
+		return items, nil
+	}
+	if cfg.StrictData {
+		return nil, fmt.Errorf("%s is corrupt, fix it or set STRICT_DATA=false to set it aside: %w", cfg.ItemsJSON, err)
+	}
+	backup := cfg.ItemsJSON + ".bak"
+	if err := os.Rename(cfg.ItemsJSON, backup); err != nil {
+		return nil, err
+	}
+	log.Warnf("%s is corrupt and was moved to %s; starting without its items: %v", cfg.ItemsJSON, backup, err)
+	return nil, nil
+}
+
+// parseItemsJSON decodes items.json, checking that every item has a name
+// and category.
+func parseItemsJSON(data []byte) ([]*Item, error) {
+	var items Items
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	for i, item := range items.Items {
+		if item == nil || strings.TrimSpace(item.Name) == "" || strings.TrimSpace(item.Category) == "" {
+			return nil, fmt.Errorf("item %d has no name or category", i)
+		}
+	}
+	return items.Items, nil
+}
+
+// selectIdempotentItemID returns the id of the item created with the
+// idempotency key since the given time, or sql.ErrNoRows.
+func selectIdempotentItemID(ctx context.Context, db *sql.DB, key string, since time.Time) (int64, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	var id int64
+	err := db.QueryRowContext(ctx, "SELECT item_id FROM idempotency_keys WHERE key = ? AND created_at >= ?",
+		key, since.UTC().Format(timeFormat)).Scan(&id)
+	return id, err
+}
+
+// duplicateItemError is returned by insertItemOnce when asked to dedup and
+// an item with the same name and category exists.
+type duplicateItemError struct {
+	ID int64
+}
+
+func (e *duplicateItemError) Error() string {
+	return fmt.Sprintf("item %d has the same name and category", e.ID)
+}
+
+// insertItemOnce inserts item in one transaction with the checks of opts,
+// described by AddOptions, and returns its id. Idempotency keys used
+// before opts.Since are forgotten.
+func insertItemOnce(ctx context.Context, db *sql.DB, item *Item, opts AddOptions) (id int64, replayed bool, err error) {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	if opts.Key != "" {
+		cutoff := opts.Since.UTC().Format(timeFormat)
+		if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", cutoff); err != nil {
+			return 0, false, err
+		}
+		err := tx.QueryRowContext(ctx, "SELECT item_id FROM idempotency_keys WHERE key = ?", opts.Key).Scan(&id)
+		if err == nil {
+			return id, true, tx.Commit()
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, false, err
+		}
+	}
+
+	if opts.Dedup {
+		if err := checkDuplicateItem(ctx, tx, item); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := checkQuota(ctx, tx, opts.MaxItems, 1); err != nil {
+		return 0, false, err
+	}
+
+	if id, err = insertItemTx(ctx, tx, item, opts.Actor); err != nil {
+		return 0, false, err
+	}
+	if opts.Key != "" {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO idempotency_keys (key, item_id) VALUES (?, ?)", opts.Key, id); err != nil {
+			return 0, false, err
+		}
+	}
+	if opts.BeforeCommit != nil {
+		if err := opts.BeforeCommit(); err != nil {
+			return 0, false, err
+		}
+	}
+	return id, false, tx.Commit()
+}
+
+// checkDuplicateItem returns a *duplicateItemError if an item not deleted
+// has the name and category of item.
+func checkDuplicateItem(ctx context.Context, q querier, item *Item) error {
+	var id int64
+	err := q.QueryRowContext(ctx, "SELECT items.id"+itemsFrom+" WHERE items.name = ? AND categories.name = ? AND "+notDeleted+
+		" ORDER BY items.id LIMIT 1", item.Name, item.Category).Scan(&id)
+	if err == nil {
+		return &duplicateItemError{ID: id}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// errQuotaExceeded is returned when adding items would exceed
+// Config.MaxItems.
+var errQuotaExceeded = errors.New("item limit reached")
+
+// checkQuota returns errQuotaExceeded if adding n items would make more
+// than max items not deleted. A max of 0 is no limit. Called in the
+// transaction adding them, so concurrent requests cannot both pass.
+func checkQuota(ctx context.Context, q querier, max, n int) error {
+	if max <= 0 {
+		return nil
+	}
+	var count int
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM items WHERE "+notDeleted).Scan(&count); err != nil {
+		return err
+	}
+	if count+n > max {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+func insertItemTx(ctx context.Context, tx *sql.Tx, item *Item, actor string) (int64, error) {
+	categoryID, err := getOrCreateCategory(ctx, tx, item.Category)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO items (name, category_id, image_name, alt_text, price, description, owner_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at, version`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var (
+		id        int64
+		createdAt string
+	)
+	if item.AltText == "" {
+		item.AltText = item.Name
+	}
+	ownerID := sql.NullString{String: item.OwnerID, Valid: item.OwnerID != ""}
+	if err := stmt.QueryRowContext(ctx, item.Name, categoryID, item.Image, item.AltText, item.Price, item.Description, ownerID).Scan(&id, &createdAt, &item.Version); err != nil {
+		return 0, err
+	}
+	if item.CreatedAt, err = parseTime(createdAt); err != nil {
+		return 0, err
+	}
+	item.setImages("", "")
+	return id, recordAudit(ctx, tx, id, auditCreate, actor)
+}
+
+// getOrCreateCategory returns the id of the named category, inserting it
+// first if needed. The UNIQUE constraint on categories.name makes this safe
+// against concurrent inserts of the same new category.
+func getOrCreateCategory(ctx context.Context, tx *sql.Tx, name string) (int64, error) {
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO categories (name) VALUES (?)", name); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name = ?", name).Scan(&id)
+	return id, err
+}
+
+// ItemQuery filters and paginates the items returned by selectItems.
+type ItemQuery struct {
+	// Name and Category, if non-empty, restrict the result to items with
+	// that name and category name.
+	Name     string
+	Category string
+	// Sort is a key of sortColumns; empty sorts by id.
+	Sort string
+	Desc bool
+	// Limit is the maximum number of items returned; a negative Limit
+	// means no limit, as in SQLite.
+	Limit  int
+	Offset int
+	// AfterID, if non-zero, restricts the result to items with a greater
+	// id, to resume iterating by id where a previous page ended.
+	AfterID int64
+	// Since, if non-zero, restricts the result to items created at or
+	// after it.
+	Since time.Time
+	// IncludeDeleted includes soft-deleted items.
+	IncludeDeleted bool
+	// MinPrice and MaxPrice, if non-nil, restrict the result to items
+	// priced within them, inclusive.
+	MinPrice *int
+	MaxPrice *int
+}
+
+// sortColumns maps the sort keys accepted by the API to the columns they
+// order by. Only these values are ever interpolated into a query.
+var sortColumns = map[string]string{
+	"id":       "items.id",
+	"name":     "items.name",
+	"category": "categories.name",
+}
+
+// orderBy returns the ORDER BY clause for q. Ties are broken by id so
+// pagination stays stable.
+func (q ItemQuery) orderBy() string {
+	column, ok := sortColumns[q.Sort]
+	if !ok {
+		column = "items.id"
+	}
+	dir := "ASC"
+	if q.Desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, items.id %s", column, dir, dir)
+}
+
+// where returns the WHERE clause for the filters in q and its arguments.
+func (q ItemQuery) where() (string, []any) {
+	conds, args := q.conds()
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// conds returns the conditions of the filters in q, to be joined by AND,
+// and their arguments.
+func (q ItemQuery) conds() (conds []string, args []any) {
+	if !q.IncludeDeleted {
+		conds = append(conds, notDeleted)
+	}
+	if q.Name != "" {
+		conds = append(conds, "items.name = ?")
+		args = append(args, q.Name)
+	}
+	if q.Category != "" {
+		conds = append(conds, "categories.name = ?")
+		args = append(args, q.Category)
+	}
+	if q.AfterID != 0 {
+		conds = append(conds, "items.id > ?")
+		args = append(args, q.AfterID)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "items.created_at >= ?")
+		args = append(args, q.Since.UTC().Format(timeFormat))
+	}
+	switch {
+	case q.MinPrice != nil && q.MaxPrice != nil:
+		conds = append(conds, "items.price BETWEEN ? AND ?")
+		args = append(args, *q.MinPrice, *q.MaxPrice)
+	case q.MinPrice != nil:
+		conds = append(conds, "items.price >= ?")
+		args = append(args, *q.MinPrice)
+	case q.MaxPrice != nil:
+		conds = append(conds, "items.price <= ?")
+		args = append(args, *q.MaxPrice)
+	}
+	return conds, args
+}
+
+// selectItems returns the page of items selected by q and the total number
+// of items matching its filters regardless of pagination.
+func selectItems(ctx context.Context, db *sql.DB, q ItemQuery) ([]*Item, int, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	total, err := queryCount(ctx, db, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	where, args := q.where()
+	args = append(args, q.Limit, q.Offset)
+	rows, err := db.QueryContext(ctx, selectItemsQuery+where+q.orderBy()+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	items, err := scanItems(rows)
+	return items, total, err
+}
+
+// selectRandomItem returns an item matching the filters of q picked at
+// random, or sql.ErrNoRows if there is none.
+func selectRandomItem(ctx context.Context, db *sql.DB, q ItemQuery) (*Item, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	where, args := q.where()
+	return scanItem(db.QueryRowContext(ctx, selectItemsQuery+where+" ORDER BY RANDOM() LIMIT 1", args...))
+}
+
+// selectRecentItems returns the n most recently created items, newest
+// first. The items_created_at index serves the ordering.
+func selectRecentItems(ctx context.Context, db *sql.DB, n int) ([]*Item, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	rows, err := db.QueryContext(ctx, selectItemsQuery+" WHERE "+notDeleted+
+		" ORDER BY items.created_at DESC, items.id DESC LIMIT ?", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanItems(rows)
+}
+
+// countItems returns the number of items matching the filters of q.
+func countItems(ctx context.Context, db *sql.DB, q ItemQuery) (int, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	return queryCount(ctx, db, q)
+}
+
+// queryCount is countItems for callers already holding itemsMu.
+func queryCount(ctx context.Context, db *sql.DB, q ItemQuery) (int, error) {
+	where, args := q.where()
+
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*)"+itemsFrom+where, args...).Scan(&n)
+	return n, err
+}
+
+// selectItem returns sql.ErrNoRows when no item has the given id.
+func selectItem(ctx context.Context, db *sql.DB, id int64) (*Item, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	stmt, err := db.PrepareContext(ctx, selectItemsQuery+" WHERE items.id = ? AND "+notDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	return scanItem(stmt.QueryRowContext(ctx, id))
+}
+
+// selectItemsByID returns the items with the given ids in the same order,
+// skipping ids with no item.
+func selectItemsByID(ctx context.Context, db *sql.DB, ids []int64) ([]*Item, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	if len(ids) == 0 {
+		return []*Item{}, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := db.QueryContext(ctx, selectItemsQuery+" WHERE items.id IN ("+placeholders+") AND "+notDeleted, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found, err := scanItems(rows)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*Item, len(found))
+	for _, item := range found {
+		byID[item.ID] = item
+	}
+	items := make([]*Item, 0, len(found))
+	for _, id := range ids {
+		if item, ok := byID[id]; ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// searchItems returns the items matching keyword, using the full-text index
+// when available. Otherwise it returns the items whose name contains
+// keyword; SQLite's LIKE is case-insensitive for ASCII characters. The
+// filters of q apply too, but not its sort order or pagination.
+func searchItems(ctx context.Context, db *sql.DB, keyword string, q ItemQuery) ([]*Item, error) {
+	if ftsEnabled {
+		return searchItemsFTS(ctx, db, keyword, q)
+	}
+
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	conds, args := q.conds()
+	conds = append([]string{`items.name LIKE ? ESCAPE '\'`}, conds...)
+	args = append([]any{"%" + escapeLike(keyword) + "%"}, args...)
+	rows, err := db.QueryContext(ctx, selectItemsQuery+" WHERE "+strings.Join(conds, " AND ")+" ORDER BY items.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanItems(rows)
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// selectCategories returns every category in name order with the number of
+// items in it.
+func selectCategories(ctx context.Context, db *sql.DB) ([]*Category, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	return queryCategories(ctx, db)
+}
+
+// queryCategories is selectCategories for callers holding itemsMu.
+func queryCategories(ctx context.Context, db *sql.DB) ([]*Category, error) {
+	rows, err := db.QueryContext(ctx, `SELECT categories.id, categories.name, COUNT(items.id)
+		FROM categories LEFT JOIN items ON items.category_id = categories.id AND items.deleted_at IS NULL
+		GROUP BY categories.id ORDER BY categories.name, categories.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []*Category{}
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.ID, &category.Name, &category.ItemCount); err != nil {
+			return nil, err
+		}
+		categories = append(categories, &category)
+	}
+	return categories, rows.Err()
+}
+
+// renameCategory renames the category with the given id, and so every item
+// in it, returning it with its item count. A name taken by another
+// category is a unique violation.
+func renameCategory(ctx context.Context, db *sql.DB, id int64, name string) (*Category, error) {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	category := Category{ID: id}
+	err := db.QueryRowContext(ctx, `UPDATE categories SET name = ? WHERE id = ?
+		RETURNING name, (SELECT COUNT(*) FROM items WHERE category_id = categories.id AND `+notDeleted+`)`,
+		name, id).Scan(&category.Name, &category.ItemCount)
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// scanItems reads every remaining row into an Item. It never returns a nil
+// slice so empty results marshal as [] rather than null.
+func scanItems(rows *sql.Rows) ([]*Item, error) {
+	items := []*Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanItem reads a row selected with selectItemsQuery.
+func scanItem(row scanner) (*Item, error) {
+	var (
+		item      Item
+		createdAt string
+		deletedAt sql.NullString
+		ownerID   sql.NullString
+		images    sql.NullString
+		altTexts  sql.NullString
+	)
+	if err := row.Scan(&item.ID, &item.Name, &item.Category, &item.Image, &item.AltText, &item.Price, &item.Description,
+		&createdAt, &deletedAt, &ownerID, &item.Version, &images, &altTexts); err != nil {
+		return nil, err
+	}
+	item.OwnerID = ownerID.String
+	item.setImages(images.String, altTexts.String)
+	var err error
+	if item.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		t, err := parseTime(deletedAt.String)
+		if err != nil {
+			return nil, err
+		}
+		item.DeletedAt = &t
+	}
+	return &item, nil
+}
+
+// softDeleteItemByID marks the item as deleted so that it is hidden but
+// can be restored.
+func softDeleteItemByID(ctx context.Context, db *sql.DB, id int64, actor string) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE items SET deleted_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		WHERE id = ? AND `+notDeleted, id)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, id, auditDelete, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// selectItemOwner returns the owner_id of the item, deleted or not, or ""
+// if it has none.
+func selectItemOwner(ctx context.Context, db *sql.DB, id int64) (string, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	var owner sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT owner_id FROM items WHERE id = ?", id).Scan(&owner)
+	return owner.String, err
+}
+
+// imageInUse reports whether any item, deleted or not, refers to the image.
+func imageInUse(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	return imageInUseTx(ctx, db, name)
+}
+
+// imageInUseTx is imageInUse for callers already holding itemsMu.
+func imageInUseTx(ctx context.Context, q querier, name string) (bool, error) {
+	var used bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM items WHERE image_name = ?)
+		OR EXISTS (SELECT 1 FROM item_images WHERE image_name = ?)`, name, name).Scan(&used)
+	return used, err
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// addItemImage attaches an extra image to the item unless it already has
+// it, and returns sql.ErrNoRows if there is no such item. altText
+// describes the image and defaults to the name of the item. beforeCommit,
+// if not nil, is called right before the transaction commits, and an
+// error from it aborts the change.
+func addItemImage(ctx context.Context, db *sql.DB, id int64, name, altText, actor string, beforeCommit func() error) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var primary, itemName string
+	if err := tx.QueryRowContext(ctx, "SELECT image_name, name FROM items WHERE id = ? AND "+notDeleted, id).Scan(&primary, &itemName); err != nil {
+		return err
+	}
+	if altText == "" {
+		altText = itemName
+	}
+	if name != primary {
+		res, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO item_images (item_id, image_name, alt_text) VALUES (?, ?, ?)", id, name, altText)
+		if err != nil {
+			return err
+		}
+		// Otherwise the item already has the image.
+		if expectOneRow(res) == nil {
+			if err := recordAudit(ctx, tx, id, auditAddImage, actor); err != nil {
+				return err
+			}
+		}
+	}
+	if beforeCommit != nil {
+		if err := beforeCommit(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteItemImage detaches an extra image from the item and reports
+// whether the image is now unused. It returns sql.ErrNoRows if the item
+// does not have the image.
+func deleteItemImage(ctx context.Context, db *sql.DB, id int64, name, actor string) (orphan bool, err error) {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM item_images WHERE item_id = ? AND image_name = ?
+		AND item_id IN (SELECT id FROM items WHERE `+notDeleted+`)`, id, name)
+	if err != nil {
+		return false, err
+	}
+	if err := expectOneRow(res); err != nil {
+		return false, err
+	}
+	if err := recordAudit(ctx, tx, id, auditDeleteImage, actor); err != nil {
+		return false, err
+	}
+	used, err := imageInUseTx(ctx, tx, name)
+	if err != nil {
+		return false, err
+	}
+	return !used, tx.Commit()
+}
+
+// restoreItemByID undoes softDeleteItemByID. Restoring an item that is not
+// deleted does nothing.
+func restoreItemByID(ctx context.Context, db *sql.DB, id int64, actor string) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deletedAt sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT deleted_at FROM items WHERE id = ?", id).Scan(&deletedAt); err != nil {
+		return err
+	}
+	if !deletedAt.Valid {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET deleted_at = NULL WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, id, auditRestore, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expectOneRow returns sql.ErrNoRows if res affected no rows.
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// deleteItemByID deletes the item and returns the names of its images that
+// no other item uses any more. It returns sql.ErrNoRows when no item has
+// the given id.
+func deleteItemByID(ctx context.Context, db *sql.DB, id int64, actor string) (orphans []string, err error) {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	images, err := deleteItemTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordAudit(ctx, tx, id, auditDelete, actor); err != nil {
+		return nil, err
+	}
+	if orphans, err = unusedImages(ctx, tx, images); err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
+}
+
+// deleteItemsByID deletes the items with the given ids in one transaction,
+// skipping ids of no item, and returns how many it deleted. If owner is
+// non-nil, only the items it owns are deleted. With soft, items are only
+// marked deleted as by softDeleteItemByID; otherwise the images nothing
+// uses any more are returned as orphans.
+func deleteItemsByID(ctx context.Context, db *sql.DB, ids []int64, owner *string, soft bool, actor string) (deleted int, orphans []string, err error) {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var images []string
+	for _, id := range ids {
+		cond, args := "id = ?", []any{id}
+		if owner != nil {
+			cond, args = cond+" AND owner_id = ?", append(args, *owner)
+		}
+		if soft {
+			res, err := tx.ExecContext(ctx, `UPDATE items SET deleted_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+				WHERE `+cond+" AND "+notDeleted, args...)
+			if err != nil {
+				return 0, nil, err
+			}
+			if expectOneRow(res) != nil {
+				continue
+			}
+			if err := recordAudit(ctx, tx, id, auditDelete, actor); err != nil {
+				return 0, nil, err
+			}
+			deleted++
+			continue
+		}
+
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM items WHERE "+cond+")", args...).Scan(&exists); err != nil {
+			return 0, nil, err
+		}
+		if !exists {
+			continue
+		}
+		itemImages, err := deleteItemTx(ctx, tx, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := recordAudit(ctx, tx, id, auditDelete, actor); err != nil {
+			return 0, nil, err
+		}
+		images = append(images, itemImages...)
+		deleted++
+	}
+	// Check only once every item is gone, as they may share images.
+	if orphans, err = unusedImages(ctx, tx, images); err != nil {
+		return 0, nil, err
+	}
+	return deleted, orphans, tx.Commit()
+}
+
+// deleteItemTx deletes the item and returns the names of the images it
+// had, or sql.ErrNoRows if there is no such item.
+func deleteItemTx(ctx context.Context, tx *sql.Tx, id int64) (images []string, err error) {
+	var primary string
+	if err := tx.QueryRowContext(ctx, "SELECT image_name FROM items WHERE id = ?", id).Scan(&primary); err != nil {
+		return nil, err
+	}
+	if images, err = queryStrings(ctx, tx, "SELECT image_name FROM item_images WHERE item_id = ?", id); err != nil {
+		return nil, err
+	}
+	if primary != "" {
+		images = append(images, primary)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_images WHERE item_id = ?", id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM items WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// unusedImages returns the images no item refers to, each once.
+func unusedImages(ctx context.Context, tx *sql.Tx, images []string) ([]string, error) {
+	var unused []string
+	seen := make(map[string]bool)
+	for _, image := range images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		// Images are named by content hash, so identical uploads share one.
+		used, err := imageInUseTx(ctx, tx, image)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			unused = append(unused, image)
+		}
+	}
+	return unused, nil
+}
+
+// queryStrings returns the single string column selected by query.
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+// errVersionConflict is returned by updateItemByID when the item is no
+// longer at the expected version.
+var errVersionConflict = errors.New("item was changed by another request")
+
+// updateItemByID stores the user-editable fields of item and sets
+// item.Version to its new version. It returns sql.ErrNoRows when no item
+// has item.ID, and errVersionConflict when version is non-zero and not the
+// version of the stored item.
+func updateItemByID(ctx context.Context, db *sql.DB, item *Item, version int, actor string) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	categoryID, err := getOrCreateCategory(ctx, tx, item.Category)
+	if err != nil {
+		return err
+	}
+
+	var stored int
+	err = tx.QueryRowContext(ctx, "SELECT version FROM items WHERE id = ? AND "+notDeleted, item.ID).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != stored {
+		return errVersionConflict
+	}
+
+	err = tx.QueryRowContext(ctx, `UPDATE items SET name = ?, category_id = ?, image_name = ?, alt_text = ?, price = ?,
+		description = ?, version = version + 1 WHERE id = ? RETURNING version`,
+		item.Name, categoryID, item.Image, item.AltText, item.Price, item.Description, item.ID).Scan(&item.Version)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, tx, item.ID, auditUpdate, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertItems inserts all items in a single transaction, so either every
+// item is stored or none is. None are if that would make more than
+// maxItems, unless it is 0.
+func insertItems(ctx context.Context, db *sql.DB, items []*Item, actor string, maxItems int) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkQuota(ctx, tx, maxItems, len(items)); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err := insertItemTx(ctx, tx, item, actor); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// forEachItem calls fn for every item in id order, streaming rows from
+// the database instead of loading them all. It does not take itemsMu so a
+// slow consumer cannot stall writers; WAL mode gives the query a
+// consistent snapshot regardless.
+func forEachItem(ctx context.Context, db *sql.DB, fn func(*Item) error) error {
+	rows, err := db.QueryContext(ctx, selectItemsQuery+" WHERE "+notDeleted+" ORDER BY items.id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// uniqueNamesIndex enforces Config.RequireUniqueNames. Soft-deleted items
+// are left out so that their names can be reused.
+const uniqueNamesIndex = `CREATE UNIQUE INDEX IF NOT EXISTS items_name_unique ON items (name) WHERE ` + notDeleted
+
+// setupUniqueNames creates or drops the index making item names unique,
+// depending on whether they are required to be.
+func setupUniqueNames(db *sql.DB, required bool) error {
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	if !required {
+		_, err := db.Exec("DROP INDEX IF EXISTS items_name_unique")
+		return err
+	}
+	if _, err := db.Exec(uniqueNamesIndex); err != nil {
+		if isUniqueViolation(err) {
+			return errors.New("REQUIRE_UNIQUE_NAMES: some items already share a name")
+		}
+		return err
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a write rejected by a UNIQUE
+// constraint, such as items having the same name under REQUIRE_UNIQUE_NAMES,
+// or by the equivalent check of JSONStore.
+func isUniqueViolation(err error) bool {
+	var se sqlite3.Error
+	return errors.Is(err, errDuplicateName) || errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// isBusy reports whether err is SQLite failing to get a lock, which is worth
+// retrying, as opposed to a genuine failure.
+func isBusy(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked)
+}
+
+// execWithRetry calls fn, retrying up to cfg.DBMaxRetries times while it
+// fails with a busy or locked error. The delay starts at cfg.DBRetryDelay
+// and doubles after every attempt. fn must be safe to repeat, i.e. run its
+// writes in a transaction.
+func execWithRetry(ctx context.Context, cfg *Config, fn func() error) error {
+	delay := cfg.DBRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt >= cfg.DBMaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%w while the database was busy: %v", ctx.Err(), err)
+		}
+		delay *= 2
+	}
+}
+
+// vacuumDB returns the pages freed by deletes to the file system. The first
+// run switches the database to incremental auto-vacuum, which takes a full
+// VACUUM; later runs only release the free pages. The caller must hold
+// itemsMu.
+func vacuumDB(ctx context.Context, db *sql.DB) (full bool, err error) {
+	var mode int
+	if err := db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, err
+	}
+	const incremental = 2
+	if mode != incremental {
+		if _, err := db.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return false, err
+		}
+		_, err := db.ExecContext(ctx, "VACUUM")
+		return true, err
+	}
+
+	// incremental_vacuum frees a page per step, so read it to the end.
+	rows, err := db.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return false, rows.Err()
+}
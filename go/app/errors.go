@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+// Error codes sent in ErrorResponse. Clients branch on these, so they must
+// not change once released.
+const (
+	codeInvalidQuery      = "INVALID_QUERY"
+	codeInvalidBody       = "INVALID_BODY"
+	codeInvalidCSV        = "INVALID_CSV"
+	codeInvalidID         = "INVALID_ID"
+	codeInvalidImageName  = "INVALID_IMAGE_NAME"
+	codeFileRequired      = "FILE_REQUIRED"
+	codeUnsupportedImage  = "UNSUPPORTED_IMAGE"
+	codeInvalidImage      = "INVALID_IMAGE"
+	codeImageDimensions   = "INVALID_IMAGE_DIMENSIONS"
+	codeImageTooLarge     = "IMAGE_TOO_LARGE"
+	codeValidationFailed  = "VALIDATION_FAILED"
+	codeDuplicateItem     = "DUPLICATE_ITEM"
+	codeDuplicateName     = "DUPLICATE_NAME"
+	codeDuplicateCategory = "DUPLICATE_CATEGORY"
+	codeForbidden         = "FORBIDDEN"
+	codeQuotaExceeded     = "QUOTA_EXCEEDED"
+	codeVersionConflict   = "VERSION_CONFLICT"
+	codeItemNotFound      = "ITEM_NOT_FOUND"
+	codeImageNotFound     = "IMAGE_NOT_FOUND"
+	codeCategoryNotFound  = "CATEGORY_NOT_FOUND"
+	codeTimeout           = "TIMEOUT"
+	codeMaintenance       = "MAINTENANCE"
+	codeInternal          = "INTERNAL_ERROR"
+)
+
+// ErrorResponse is the body of every error response. Errors lists the
+// invalid fields when Code is codeValidationFailed.
+type ErrorResponse struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// APIError is an error a handler returns to answer with ErrorResponse.
+// Err, if non-nil, is logged but never sent to the client.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func newAPIError(status int, code, message string, err error) *APIError {
+	return &APIError{Status: status, Code: code, Message: message, Err: err}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// responseStatus returns the status of the response to c, given the error
+// returned by its handler. An error not answered yet is answered further
+// out, with the status it maps to.
+func responseStatus(c echo.Context, err error) int {
+	if err != nil && !c.Response().Committed {
+		status, _, _ := errorResponse(err)
+		return status
+	}
+	return c.Response().Status
+}
+
+// errorResponse maps err to the status and body to answer with. log
+// reports whether err is a failure of the server worth logging.
+func errorResponse(err error) (status int, res ErrorResponse, log bool) {
+	var (
+		apiErr  *APIError
+		httpErr *echo.HTTPError
+		verrs   validator.ValidationErrors
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Status, ErrorResponse{Code: apiErr.Code, Message: apiErr.Message}, apiErr.Err != nil
+	case errors.As(err, &verrs):
+		errs := fieldErrors(verrs)
+		return http.StatusBadRequest, ErrorResponse{Code: codeValidationFailed, Message: errs[0].Message, Errors: errs}, false
+	case errors.As(err, &httpErr):
+		// Errors from Echo itself and its middleware, e.g. unknown routes
+		// and rate limiting.
+		message, ok := httpErr.Message.(string)
+		if !ok {
+			message = http.StatusText(httpErr.Code)
+		}
+		code := strings.ToUpper(strings.ReplaceAll(http.StatusText(httpErr.Code), " ", "_"))
+		return httpErr.Code, ErrorResponse{Code: code, Message: message}, httpErr.Code >= http.StatusInternalServerError
+	}
+	return http.StatusInternalServerError, ErrorResponse{Code: codeInternal, Message: "Internal server error"}, true
+}
+
+// errorHandledKey marks a request whose error handleError has answered.
+const errorHandledKey = "errorHandled"
+
+// handleError is the echo.HTTPErrorHandler of the server. The message is
+// sent in the language preferred by the Accept-Language header.
+//
+// The Logger middleware answers the error to log its status and passes it
+// on, so Echo calls handleError again; only the first call counts, or the
+// error would be logged twice.
+func handleError(err error, c echo.Context) {
+	if handled, _ := c.Get(errorHandledKey).(bool); handled {
+		return
+	}
+	c.Set(errorHandledKey, true)
+	status, res, log := errorResponse(err)
+	if log {
+		logError(c, err)
+	}
+	if c.Response().Committed {
+		return
+	}
+	lang := preferredLanguage(c.Request().Header.Get("Accept-Language"))
+	res = localize(res, lang)
+	h := c.Response().Header()
+	h.Set("Content-Language", lang)
+	h.Add(echo.HeaderVary, "Accept-Language")
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, res)
+	}
+	if err != nil {
+		logError(c, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "sync"
+
+// eventBuffer is how many events a subscriber may fall behind by before
+// it misses some.
+const eventBuffer = 16
+
+// Types of ItemEvent.
+const eventItemAdded = "item.added"
+
+// ItemEvent is pushed to the clients watching for changes to items.
+type ItemEvent struct {
+	Type string `json:"type"`
+	Item *Item  `json:"item"`
+}
+
+// hub fans ItemEvents out to subscribers. The zero value is ready to use.
+type hub struct {
+	mu     sync.Mutex
+	subs   map[chan ItemEvent]struct{}
+	closed bool
+}
+
+// subscribe returns a channel receiving every event published from now on
+// and a function to stop receiving them. The channel is closed by either
+// that function or close.
+func (h *hub) subscribe() (<-chan ItemEvent, func()) {
+	ch := make(chan ItemEvent, eventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan ItemEvent]struct{})
+	}
+	h.subs[ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends ev to every subscriber without waiting: a subscriber whose
+// buffer is full misses it rather than hold up the request publishing it.
+func (h *hub) publish(ev ItemEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close ends every subscription, present and future, so that long-lived
+// connections finish when the server shuts down.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+	h.closed = true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// ftsEnabled reports whether searchItems uses the items_fts full-text index.
+// It needs FTS5, which go-sqlite3 only includes when built with
+// -tags sqlite_fts5; otherwise searches fall back to LIKE.
+var ftsEnabled bool
+
+// ftsTriggers keep items_fts in sync with items. items_fts is an external
+// content table, so it stores only the index and reads rows from items.
+var ftsTriggers = map[string]string{
+	"items_fts_insert": `CREATE TRIGGER items_fts_insert AFTER INSERT ON items BEGIN
+		INSERT INTO items_fts (rowid, name, description) VALUES (new.id, new.name, new.description);
+	END`,
+	"items_fts_delete": `CREATE TRIGGER items_fts_delete AFTER DELETE ON items BEGIN
+		INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+	END`,
+	"items_fts_update": `CREATE TRIGGER items_fts_update AFTER UPDATE ON items BEGIN
+		INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+		INSERT INTO items_fts (rowid, name, description) VALUES (new.id, new.name, new.description);
+	END`,
+}
+
+// setupFTS creates items_fts and its triggers when SQLite supports FTS5.
+// Otherwise it drops the triggers, which would make every write fail, and
+// items_fts is rebuilt once a binary with FTS5 runs again.
+func setupFTS(db *sql.DB) error {
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&ftsEnabled); err != nil {
+		return err
+	}
+
+	itemsMu.Lock()
+	defer itemsMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var triggers int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'items\_fts\_%' ESCAPE '\'`).Scan(&triggers); err != nil {
+		return err
+	}
+	if ftsEnabled && triggers == len(ftsTriggers) {
+		return nil
+	}
+
+	for name := range ftsTriggers {
+		if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+			return err
+		}
+	}
+	if ftsEnabled {
+		if _, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS items_fts USING fts5(
+			name, description, content = 'items', content_rowid = 'id'
+		)`); err != nil {
+			return err
+		}
+		for _, stmt := range ftsTriggers {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		// Index the items written while the triggers were missing.
+		if _, err := tx.Exec(`INSERT INTO items_fts (items_fts) VALUES ('rebuild')`); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ftsQuery turns keyword into an FTS5 query matching items with a word
+// starting with each word of keyword. Words are quoted so that FTS5
+// operators in keyword are taken literally.
+func ftsQuery(keyword string) string {
+	words := strings.Fields(keyword)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// searchItemsFTS returns the items matching keyword by name or description
+// and the filters of q, most relevant first.
+func searchItemsFTS(ctx context.Context, db *sql.DB, keyword string, q ItemQuery) ([]*Item, error) {
+	query := ftsQuery(keyword)
+	if query == "" {
+		return []*Item{}, nil
+	}
+
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	conds, args := q.conds()
+	conds = append([]string{"items_fts MATCH ?"}, conds...)
+	args = append([]any{query}, args...)
+	rows, err := db.QueryContext(ctx, selectItemsQuery+
+		" JOIN items_fts ON items_fts.rowid = items.id WHERE "+strings.Join(conds, " AND ")+
+		" ORDER BY items_fts.rank, items.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanItems(rows)
+}
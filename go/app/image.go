@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailSize is the maximum width and height of a thumbnail.
+const thumbnailSize = 200
+
+// imageTypes are the image content types accepted on upload.
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+var (
+	errUnsupportedImage = errors.New("unsupported image type")
+	errInvalidImage     = errors.New("image cannot be decoded")
+	errImageTooLarge    = errors.New("image file is too large")
+)
+
+// imageLimits are the smallest and largest dimensions, in pixels, and the
+// largest file size of an image accepted on upload.
+type imageLimits struct {
+	MinWidth, MinHeight int
+	MaxWidth, MaxHeight int
+	MaxBytes            int64
+}
+
+// imageSizeError is returned for an image outside its imageLimits.
+type imageSizeError struct {
+	Width, Height int
+	TooLarge      bool
+	Limits        imageLimits
+}
+
+func (e *imageSizeError) Error() string {
+	if e.TooLarge {
+		return fmt.Sprintf("image is %dx%d pixels, larger than the maximum of %dx%d",
+			e.Width, e.Height, e.Limits.MaxWidth, e.Limits.MaxHeight)
+	}
+	return fmt.Sprintf("image is %dx%d pixels, smaller than the minimum of %dx%d",
+		e.Width, e.Height, e.Limits.MinWidth, e.Limits.MinHeight)
+}
+
+// check returns an *imageSizeError if an image of the given dimensions is
+// outside l.
+func (l imageLimits) check(width, height int) error {
+	switch {
+	case width > l.MaxWidth || height > l.MaxHeight:
+		return &imageSizeError{Width: width, Height: height, TooLarge: true, Limits: l}
+	case width < l.MinWidth || height < l.MinHeight:
+		return &imageSizeError{Width: width, Height: height, Limits: l}
+	}
+	return nil
+}
+
+// ensureImgDir creates the image directory dir if it does not exist, and
+// reports whether it did. It fails if dir is not a directory.
+func ensureImgDir(dir string) (created bool, err error) {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("image directory %s is not a directory", dir)
+	}
+	return false, nil
+}
+
+// saveImage stores the uploaded image in dir as prepared by prepareImage
+// and returns the resulting file name. As names are content hashes, an
+// image already stored is reused rather than written again, and reused
+// reports so. One of a different size, e.g. cut short by a crash, is
+// replaced.
+func saveImage(dir string, quality int, limits imageLimits, imageFile *multipart.FileHeader) (name string, reused bool, err error) {
+	img, err := stageImage(dir, quality, limits, imageFile)
+	if err != nil {
+		return "", false, err
+	}
+	defer img.discard()
+	if err := img.commit(); err != nil {
+		return "", false, err
+	}
+	return img.Name, img.Reused, nil
+}
+
+// stagedImage is an uploaded image written to a temporary file in the
+// image directory, so that it only takes its name once the item using it
+// is stored.
+type stagedImage struct {
+	Name   string
+	Reused bool
+
+	tmpPath, path string
+}
+
+// stageImage prepares the uploaded image like saveImage but leaves it
+// under a temporary name until commit. A reused image needs no file.
+func stageImage(dir string, quality int, limits imageLimits, imageFile *multipart.FileHeader) (*stagedImage, error) {
+	name, data, err := prepareImage(quality, limits, imageFile)
+	if err != nil {
+		return nil, err
+	}
+	img := &stagedImage{Name: name, path: path.Join(dir, name)}
+	if info, err := os.Stat(img.path); err == nil && info.Mode().IsRegular() && info.Size() == int64(len(data)) {
+		img.Reused = true
+		return img, nil
+	}
+
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	img.tmpPath = f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(img.tmpPath, 0644)
+	}
+	if err != nil {
+		img.discard()
+		return nil, err
+	}
+	return img, nil
+}
+
+// commit renames the image into place. Committing twice is harmless, as
+// a store may retry the transaction it commits the image in.
+func (img *stagedImage) commit() error {
+	if img.tmpPath == "" {
+		return nil
+	}
+	if err := os.Rename(img.tmpPath, img.path); err != nil {
+		return err
+	}
+	img.tmpPath = ""
+	return nil
+}
+
+// discard removes the temporary file of an image not committed.
+func (img *stagedImage) discard() {
+	if img == nil || img.tmpPath == "" {
+		return
+	}
+	if err := os.Remove(img.tmpPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("failed to remove %s: %v", img.tmpPath, err)
+	}
+	img.tmpPath = ""
+}
+
+// prepareImage returns the uploaded image as a JPEG, along with its file
+// name: the SHA-256 hash of its contents. JPEGs are kept as uploaded;
+// other images are converted with the given quality. Images outside limits
+// are rejected before they are decoded in full.
+func prepareImage(quality int, limits imageLimits, imageFile *multipart.FileHeader) (name string, data []byte, err error) {
+	if imageFile.Size > limits.MaxBytes {
+		return "", nil, errImageTooLarge
+	}
+	src, err := imageFile.Open()
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+
+	if data, err = io.ReadAll(src); err != nil {
+		return "", nil, err
+	}
+	contentType := http.DetectContentType(data)
+	if !imageTypes[contentType] {
+		return "", nil, errUnsupportedImage
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, errInvalidImage
+	}
+	if err := limits.check(cfg.Width, cfg.Height); err != nil {
+		return "", nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, errInvalidImage
+	}
+	if contentType != "image/jpeg" {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality}); err != nil {
+			return "", nil, err
+		}
+		data = buf.Bytes()
+	}
+	return fmt.Sprintf("%x.jpg", sha256.Sum256(data)), data, nil
+}
+
+// detectContentType sniffs the content type of the file at name.
+func detectContentType(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// DetectContentType considers at most the first 512 bytes.
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// thumbnailPath returns where the thumbnail of the image at imgPath is
+// cached. Thumbnails are always JPEGs.
+func thumbnailPath(imgPath string) string {
+	return strings.TrimSuffix(imgPath, filepath.Ext(imgPath)) + "_thumb.jpg"
+}
+
+// ensureThumbnail writes a JPEG thumbnail of the image at src to dst, with
+// the given quality, unless dst already exists. Decoding cannot be
+// interrupted, so ctx is checked between the steps instead.
+func ensureThumbnail(ctx context.Context, src, dst string, quality int) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	thumb := resize(img, thumbnailSize)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a
+	// partially written thumbnail.
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: quality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// flatten draws img over a white background, as JPEGs have no
+// transparency and would show transparent pixels black.
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// resize scales img down so that neither side exceeds max, preserving its
+// aspect ratio. Images that already fit are returned unchanged.
+func resize(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+	if w > h {
+		w, h = max, h*max/w
+	} else {
+		w, h = w*max/h, max
+	}
+	// A very long, thin image would otherwise round down to no pixels.
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
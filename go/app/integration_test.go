@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newIntegrationServer serves the full app from a real HTTP server backed
+// by a temporary SQLite file.
+func newIntegrationServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(newEcho(newTestServer(t)))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends req and decodes a JSON response into v, if non-nil.
+func do(t *testing.T, req *http.Request, wantStatus int, v any) *http.Response {
+	t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != wantStatus {
+		t.Fatalf("%s %s: status = %d, want %d", req.Method, req.URL.Path, res.StatusCode, wantStatus)
+	}
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return res
+}
+
+func newRequest(t *testing.T, method, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestIntegrationItemLifecycle(t *testing.T) {
+	ts := newIntegrationServer(t)
+	api := ts.URL + "/api/v1"
+
+	// Add
+	body, contentType := newAddItemBody(t, "jacket", "fashion", testImage)
+	req, err := http.NewRequest(http.MethodPost, api+"/items", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	var added Item
+	res := do(t, req, http.StatusCreated, &added)
+	location := res.Header.Get("Location")
+	if location != "/api/v1/items/"+strconv.FormatInt(added.ID, 10) {
+		t.Fatalf("Location = %q for item %d", location, added.ID)
+	}
+
+	// Get
+	var got Item
+	do(t, newRequest(t, http.MethodGet, ts.URL+location), http.StatusOK, &got)
+	if !reflect.DeepEqual(got, added) {
+		t.Errorf("GET %s = %+v, want %+v", location, got, added)
+	}
+
+	// Search
+	var found Items
+	do(t, newRequest(t, http.MethodGet, api+"/search?keyword=jack"), http.StatusOK, &found)
+	if len(found.Items) != 1 || found.Items[0].ID != added.ID {
+		t.Errorf("search = %+v, want item %d", found.Items, added.ID)
+	}
+
+	// Delete
+	do(t, newRequest(t, http.MethodDelete, ts.URL+location), http.StatusNoContent, nil)
+
+	var errRes ErrorResponse
+	do(t, newRequest(t, http.MethodGet, ts.URL+location), http.StatusNotFound, &errRes)
+	if errRes.Code != codeItemNotFound {
+		t.Errorf("code = %q, want %q", errRes.Code, codeItemNotFound)
+	}
+	var page ItemEnvelope
+	do(t, newRequest(t, http.MethodGet, api+"/items"), http.StatusOK, &page)
+	if len(page.Data) != 0 || page.Meta.Total != 0 {
+		t.Errorf("items after delete = %+v, total %d", page.Data, page.Meta.Total)
+	}
+	found = Items{}
+	do(t, newRequest(t, http.MethodGet, api+"/search?keyword=jack"), http.StatusOK, &found)
+	if len(found.Items) != 0 {
+		t.Errorf("search after delete = %+v", found.Items)
+	}
+	do(t, newRequest(t, http.MethodDelete, ts.URL+location), http.StatusNotFound, nil)
+}
+
+func TestIntegrationWatchItems(t *testing.T) {
+	ts := newIntegrationServer(t)
+	api := ts.URL + "/api/v1"
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	body, contentType := newAddItemBody(t, "jacket", "fashion", testImage)
+	req, err := http.NewRequest(http.MethodPost, api+"/items", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	var added Item
+	do(t, req, http.StatusCreated, &added)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ev ItemEvent
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != eventItemAdded || ev.Item == nil || !reflect.DeepEqual(*ev.Item, added) {
+		t.Errorf("event = %+v, want %s of %+v", ev, eventItemAdded, added)
+	}
+}
+
+func TestIntegrationStreamItems(t *testing.T) {
+	ts := newIntegrationServer(t)
+	api := ts.URL + "/api/v1"
+
+	res, err := http.Get(api + "/items/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	body, contentType := newAddItemBody(t, "jacket", "fashion", testImage)
+	req, err := http.NewRequest(http.MethodPost, api+"/items", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	var added Item
+	do(t, req, http.StatusCreated, &added)
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		name, value, _ := strings.Cut(scanner.Text(), ": ")
+		fields[name] = value
+	}
+	if fields["event"] != eventItemAdded || fields["id"] != strconv.FormatInt(added.ID, 10) {
+		t.Fatalf("event = %v, want %s of item %d", fields, eventItemAdded, added.ID)
+	}
+	var ev ItemEvent
+	if err := json.Unmarshal([]byte(fields["data"]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Item == nil || !reflect.DeepEqual(*ev.Item, added) {
+		t.Errorf("data = %+v, want %+v", ev.Item, added)
+	}
+}
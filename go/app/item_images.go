@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ItemImages lists the images of an item, primary first, and what each
+// shows.
+type ItemImages struct {
+	Images   []string `json:"images"`
+	AltTexts []string `json:"alt_texts"`
+}
+
+func (s *Server) getItemImages(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+
+	return s.answerItemImages(c, http.StatusOK, id)
+}
+
+func (s *Server) answerItemImages(c echo.Context, status int, id int64) error {
+	item, err := selectItem(c.Request().Context(), s.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+	return c.JSON(status, ItemImages{Images: item.Images, AltTexts: item.AltTexts})
+}
+
+// addItemImage adds the uploaded image to an item, after its primary image
+// and any added before, with the alt text sent along.
+func (s *Server) addItemImage(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+
+	imageFile, err := requiredImage(c)
+	if err != nil {
+		return err
+	}
+	if err := s.addOneImage(c, id, imageFile, c.FormValue("alt_text")); err != nil {
+		return err
+	}
+	return s.answerItemImages(c, http.StatusCreated, id)
+}
+
+// maxBatchImages caps the images of one POST /items/:id/images/batch.
+const maxBatchImages = 20
+
+// BatchImagesResponse reports the outcome of POST /items/:id/images/batch.
+// Images lists the images of the item afterwards, primary first, and
+// AltTexts what each shows.
+type BatchImagesResponse struct {
+	Added    int             `json:"added"`
+	Rejected []RejectedImage `json:"rejected"`
+	Images   []string        `json:"images"`
+	AltTexts []string        `json:"alt_texts"`
+}
+
+// RejectedImage is the ErrorResponse of an image left out of a batch,
+// extended with which part it was.
+type RejectedImage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Index   int    `json:"index"`
+	File    string `json:"file"`
+}
+
+// addItemImages adds every image part of a multipart body to an item like
+// addItemImage. The n-th alt_text part, if any, describes the n-th image.
+// Each is stored independently, so valid images are added even if others
+// are rejected.
+func (s *Server) addItemImages(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid multipart body", nil)
+	}
+	files := form.File["image"]
+	if len(files) == 0 {
+		return newAPIError(http.StatusBadRequest, codeFileRequired, "Image file is required", nil)
+	}
+	if len(files) > maxBatchImages {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed,
+			fmt.Sprintf("at most %d images can be uploaded at once", maxBatchImages), nil)
+	}
+	if _, err := selectItem(c.Request().Context(), s.db, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	} else if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+
+	lang := preferredLanguage(c.Request().Header.Get("Accept-Language"))
+	res := BatchImagesResponse{Rejected: []RejectedImage{}}
+	altTexts := form.Value["alt_text"]
+	for i, fh := range files {
+		var altText string
+		if i < len(altTexts) {
+			altText = altTexts[i]
+		}
+		err := s.addOneImage(c, id, fh, altText)
+		if err == nil {
+			res.Added++
+			continue
+		}
+		status, e, log := errorResponse(err)
+		if log {
+			logError(c, err)
+		}
+		if status == http.StatusNotFound {
+			// The item was deleted meanwhile; the other images would fail too.
+			return err
+		}
+		e = localize(e, lang)
+		res.Rejected = append(res.Rejected, RejectedImage{Code: e.Code, Message: e.Message, Index: i, File: fh.Filename})
+	}
+
+	item, err := selectItem(c.Request().Context(), s.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+	res.Images, res.AltTexts = item.Images, item.AltTexts
+	return c.JSON(http.StatusCreated, res)
+}
+
+// addOneImage stores one uploaded image and adds it to the item with
+// altText. Like in addItem, the image only takes its name as the change is
+// committed.
+func (s *Server) addOneImage(c echo.Context, id int64, fh *multipart.FileHeader, altText string) error {
+	req := ItemImageRequest{AltText: sanitizeName(altText)}
+	if err := c.Validate(&req); err != nil {
+		return err
+	}
+	img, err := stageImage(s.cfg.ImgDir, s.cfg.ImageQuality, s.imageLimits(), fh)
+	if err != nil {
+		return imageError(err)
+	}
+	defer img.discard()
+
+	err = execWithRetry(c.Request().Context(), s.cfg, func() error {
+		return addItemImage(c.Request().Context(), s.db, id, img.Name, req.AltText, s.actor(c), img.commit)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		if !img.Reused {
+			// The image may have been moved into place before the commit
+			// failed.
+			s.removeUnusedImage(c, img.Name)
+		}
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to add image", err)
+	}
+	return nil
+}
+
+// deleteItemImage removes an image added with addItemImage. The primary
+// image stays until the item is deleted.
+func (s *Server) deleteItemImage(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+	name, err := cleanImageName(c.Param("imageFilename"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidImageName, "Invalid image file name", nil)
+	}
+
+	var orphan bool
+	err = execWithRetry(c.Request().Context(), s.cfg, func() (err error) {
+		orphan, err = deleteItemImage(c.Request().Context(), s.db, id, name, s.actor(c))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeImageNotFound, "item has no such extra image", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to delete image", err)
+	}
+	if orphan && name != defaultImage {
+		s.removeImage(c, name)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
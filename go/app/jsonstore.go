@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDuplicateName is returned by JSONStore when unique names are required
+// and the name of an item is taken, like the UNIQUE index does in SQLite.
+var errDuplicateName = errors.New("item name is taken")
+
+// JSONStore is the ItemStore of the json backend, which keeps the items in
+// memory and rewrites the items.json file they are loaded from after every
+// change. It has no soft delete, and idempotency keys are forgotten on
+// restart.
+type JSONStore struct {
+	path        string
+	uniqueNames bool
+
+	mu     sync.RWMutex
+	items  []*Item // in id order
+	nextID int64
+	keys   map[string]idempotencyKey
+}
+
+type idempotencyKey struct {
+	itemID    int64
+	createdAt time.Time
+}
+
+// jsonStoreFile is the items.json file written by JSONStore. next_id keeps
+// the ids of deleted items from being reused after a restart, as SQLite
+// does with AUTOINCREMENT.
+type jsonStoreFile struct {
+	NextID int64   `json:"next_id"`
+	Items  []*Item `json:"items"`
+}
+
+// newJSONStore loads the store from the items.json file at path, which may
+// be missing. Items without an id, such as those of a legacy file, are
+// numbered after the others.
+func newJSONStore(path string, uniqueNames bool) (*JSONStore, error) {
+	st := &JSONStore{path: path, uniqueNames: uniqueNames, nextID: 1, keys: make(map[string]idempotencyKey)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if st.items, err = parseItemsJSON(data); err != nil {
+		return nil, err
+	}
+	var file jsonStoreFile
+	if err := json.Unmarshal(data, &file); err == nil && file.NextID > st.nextID {
+		st.nextID = file.NextID
+	}
+	for _, item := range st.items {
+		if item.ID >= st.nextID {
+			st.nextID = item.ID + 1
+		}
+	}
+	for _, item := range st.items {
+		if item.ID == 0 {
+			item.ID = st.nextID
+			st.nextID++
+		}
+		if item.Version == 0 {
+			item.Version = 1
+		}
+		if item.AltText == "" {
+			item.AltText = item.Name
+		}
+		if item.Images == nil || item.AltTexts == nil {
+			item.setImages("", "")
+		}
+	}
+	sort.Slice(st.items, func(i, j int) bool { return st.items[i].ID < st.items[j].ID })
+	return st, nil
+}
+
+// save rewrites the file through a temporary one, so that a crash never
+// leaves it half written.
+func (st *JSONStore) save() error {
+	data, err := json.MarshalIndent(jsonStoreFile{NextID: st.nextID, Items: st.items}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), ".items-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
+
+// copyItem returns a copy of item the caller may modify.
+func copyItem(item *Item) *Item {
+	c := *item
+	c.Images = append([]string{}, item.Images...)
+	c.AltTexts = append([]string{}, item.AltTexts...)
+	return &c
+}
+
+// index returns the position of the item with the given id, or -1.
+func (st *JSONStore) index(id int64) int {
+	i := sort.Search(len(st.items), func(i int) bool { return st.items[i].ID >= id })
+	if i < len(st.items) && st.items[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// matches reports whether item passes the filters of q. There are no
+// deleted items to include.
+func (q ItemQuery) matches(item *Item) bool {
+	switch {
+	case q.Name != "" && item.Name != q.Name,
+		q.Category != "" && item.Category != q.Category,
+		item.ID <= q.AfterID,
+		!q.Since.IsZero() && item.CreatedAt.Before(q.Since),
+		q.MinPrice != nil && item.Price < *q.MinPrice,
+		q.MaxPrice != nil && item.Price > *q.MaxPrice:
+		return false
+	}
+	return true
+}
+
+// less orders items as orderBy does in SQL.
+func (q ItemQuery) less(a, b *Item) bool {
+	var ka, kb string
+	switch q.Sort {
+	case "name":
+		ka, kb = a.Name, b.Name
+	case "category":
+		ka, kb = a.Category, b.Category
+	}
+	if ka == kb {
+		if q.Desc {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	}
+	if q.Desc {
+		return ka > kb
+	}
+	return ka < kb
+}
+
+func (st *JSONStore) GetAll(ctx context.Context, q ItemQuery) ([]*Item, int, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var matched []*Item
+	for _, item := range st.items {
+		if q.matches(item) {
+			matched = append(matched, item)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return q.less(matched[i], matched[j]) })
+
+	total := len(matched)
+	if q.Offset < len(matched) {
+		matched = matched[q.Offset:]
+	} else {
+		matched = nil
+	}
+	if q.Limit >= 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	items := make([]*Item, len(matched))
+	for i, item := range matched {
+		items[i] = copyItem(item)
+	}
+	return items, total, nil
+}
+
+func (st *JSONStore) Count(ctx context.Context, q ItemQuery) (int, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	n := 0
+	for _, item := range st.items {
+		if q.matches(item) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (st *JSONStore) GetByID(ctx context.Context, id int64) (*Item, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	i := st.index(id)
+	if i < 0 {
+		return nil, sql.ErrNoRows
+	}
+	return copyItem(st.items[i]), nil
+}
+
+func (st *JSONStore) GetByIDs(ctx context.Context, ids []int64) ([]*Item, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	items := []*Item{}
+	for _, id := range ids {
+		if i := st.index(id); i >= 0 {
+			items = append(items, copyItem(st.items[i]))
+		}
+	}
+	return items, nil
+}
+
+// nameTaken reports whether an item other than the one with the given id
+// is named name, when names must be unique.
+func (st *JSONStore) nameTaken(name string, id int64) bool {
+	if !st.uniqueNames {
+		return false
+	}
+	for _, item := range st.items {
+		if item.Name == name && item.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *JSONStore) Add(ctx context.Context, item *Item, opts AddOptions) (int64, bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if opts.Key != "" {
+		for key, k := range st.keys {
+			if k.createdAt.Before(opts.Since) {
+				delete(st.keys, key)
+			}
+		}
+		if k, ok := st.keys[opts.Key]; ok {
+			return k.itemID, true, nil
+		}
+	}
+	if opts.Dedup {
+		for _, other := range st.items {
+			if other.Name == item.Name && other.Category == item.Category {
+				return 0, false, &duplicateItemError{ID: other.ID}
+			}
+		}
+	}
+	if st.nameTaken(item.Name, 0) {
+		return 0, false, errDuplicateName
+	}
+	if opts.MaxItems > 0 && len(st.items) >= opts.MaxItems {
+		return 0, false, errQuotaExceeded
+	}
+	if opts.BeforeCommit != nil {
+		if err := opts.BeforeCommit(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	if item.AltText == "" {
+		item.AltText = item.Name
+	}
+	item.ID = st.nextID
+	item.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	item.Version = 1
+	item.setImages("", "")
+	st.items = append(st.items, copyItem(item))
+	st.nextID++
+	if err := st.save(); err != nil {
+		st.items = st.items[:len(st.items)-1]
+		st.nextID--
+		return 0, false, err
+	}
+	if opts.Key != "" {
+		st.keys[opts.Key] = idempotencyKey{itemID: item.ID, createdAt: time.Now()}
+	}
+	return item.ID, false, nil
+}
+
+func (st *JSONStore) Update(ctx context.Context, item *Item, version int, actor string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i := st.index(item.ID)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	stored := st.items[i]
+	if version != 0 && version != stored.Version {
+		return errVersionConflict
+	}
+	if st.nameTaken(item.Name, item.ID) {
+		return errDuplicateName
+	}
+
+	updated := copyItem(stored)
+	updated.Name, updated.Category, updated.Price, updated.Description = item.Name, item.Category, item.Price, item.Description
+	updated.Image, updated.Images, updated.AltText = item.Image, append([]string{}, item.Images...), item.AltText
+	updated.AltTexts = append([]string{}, item.AltTexts...)
+	updated.Version++
+	st.items[i] = updated
+	if err := st.save(); err != nil {
+		st.items[i] = stored
+		return err
+	}
+	item.Version = updated.Version
+	return nil
+}
+
+func (st *JSONStore) Delete(ctx context.Context, id int64, actor string) ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i := st.index(id)
+	if i < 0 {
+		return nil, sql.ErrNoRows
+	}
+	old := st.items
+	deleted := old[i]
+	st.items = append(append([]*Item{}, old[:i]...), old[i+1:]...)
+	if err := st.save(); err != nil {
+		st.items = old
+		return nil, err
+	}
+
+	var orphans []string
+	for _, image := range deleted.Images {
+		if !st.imageInUse(image) {
+			orphans = append(orphans, image)
+		}
+	}
+	return orphans, nil
+}
+
+// Search matches keyword against item names, ignoring case, like the LIKE
+// fallback of the sqlite backend.
+func (st *JSONStore) Search(ctx context.Context, keyword string, q ItemQuery) ([]*Item, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	keyword = strings.ToLower(keyword)
+	items := []*Item{}
+	for _, item := range st.items {
+		if strings.Contains(strings.ToLower(item.Name), keyword) && q.matches(item) {
+			items = append(items, copyItem(item))
+		}
+	}
+	return items, nil
+}
+
+func (st *JSONStore) Owner(ctx context.Context, id int64) (string, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	i := st.index(id)
+	if i < 0 {
+		return "", sql.ErrNoRows
+	}
+	return st.items[i].OwnerID, nil
+}
+
+func (st *JSONStore) ImageInUse(ctx context.Context, name string) (bool, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.imageInUse(name), nil
+}
+
+func (st *JSONStore) imageInUse(name string) bool {
+	for _, item := range st.items {
+		for _, image := range item.Images {
+			if image == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (st *JSONStore) IdempotentItemID(ctx context.Context, key string, since time.Time) (int64, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	k, ok := st.keys[key]
+	if !ok || k.createdAt.Before(since) {
+		return 0, sql.ErrNoRows
+	}
+	return k.itemID, nil
+}
+
+func (st *JSONStore) Ping(ctx context.Context) error {
+	return nil
+}
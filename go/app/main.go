@@ -1,45 +1,286 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
-)
-
-const (
-	ImgDir = "images"
-	itemsJson = "./items.json"
+	"golang.org/x/time/rate"
 )
 
 type Response struct {
 	Message string `json:"message"`
 }
 
+// Server holds the dependencies shared by the HTTP handlers.
+type Server struct {
+	cfg *Config
+	// store serves the core item routes. db is the database of the sqlite
+	// backend, also used directly by the routes only it supports, and nil
+	// with the json backend.
+	store ItemStore
+	db    *sql.DB
+	// lastWrite is the time of the last write request in Unix nanoseconds.
+	lastWrite atomic.Int64
+	// readOnly rejects write requests, see Config.ReadOnly.
+	readOnly atomic.Bool
+	// events notifies watchers of added items.
+	events hub
+	// stats caches the figures of GET /stats.
+	stats statsCache
+	// itemsCache holds the responses of GET /items until the next write.
+	itemsCache responseCache
+}
+
 type Item struct {
-	Name     string `json:"name"`
-	Category string `json:"category"`
-	Image    string `json:"image_name"`
+	ID          int64      `json:"id" xml:"id"`
+	Name        string     `json:"name" xml:"name"`
+	Category    string     `json:"category" xml:"category"`
+	Image       string     `json:"image_name" xml:"image_name"`
+	AltText     string     `json:"alt_text" xml:"alt_text"` // describes Image, by default with the name
+	Price       int        `json:"price" xml:"price"`       // in yen
+	Description string     `json:"description" xml:"description"`
+	CreatedAt   time.Time  `json:"created_at" xml:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	// OwnerID is the subject of the token the item was added with, if any.
+	OwnerID string `json:"owner_id,omitempty" xml:"owner_id,omitempty"`
+	// Version starts at 1 and increases with every update.
+	Version int `json:"version" xml:"version"`
+	// Images lists Image, the primary image, followed by any added with
+	// POST /items/:id/images.
+	Images []string `json:"images" xml:"images>image"`
+	// AltTexts describes each of Images in turn, starting with AltText.
+	AltTexts []string `json:"alt_texts" xml:"alt_texts>alt_text"`
+}
+
+// altTextSep separates the alt texts of the extra images of an item, which
+// unlike their names may contain commas.
+const altTextSep = "\x1f"
+
+// setImages sets item.Images from Image and the comma-separated names of
+// the extra images, and item.AltTexts from AltText and the alt texts of
+// the extra images separated by altTextSep.
+func (item *Item) setImages(extra, extraAltTexts string) {
+	item.Images, item.AltTexts = []string{}, []string{}
+	if item.Image != "" {
+		item.Images = append(item.Images, item.Image)
+		item.AltTexts = append(item.AltTexts, item.AltText)
+	}
+	if extra != "" {
+		item.Images = append(item.Images, strings.Split(extra, ",")...)
+		item.AltTexts = append(item.AltTexts, strings.Split(extraAltTexts, altTextSep)...)
+	}
+}
+
+// setPrimaryImage replaces Image, the first of Images, with name.
+func (item *Item) setPrimaryImage(name string) {
+	if item.Image != "" && len(item.Images) > 0 {
+		item.Images[0] = name
+	} else {
+		item.Images = append([]string{name}, item.Images...)
+		item.AltTexts = append([]string{item.AltText}, item.AltTexts...)
+	}
+	item.Image = name
+}
+
+// setAltText replaces AltText, the first of AltTexts if there is an image.
+func (item *Item) setAltText(altText string) {
+	if item.Image != "" && len(item.AltTexts) > 0 {
+		item.AltTexts[0] = altText
+	}
+	item.AltText = altText
 }
 
 type Items struct {
 	Items []*Item `json:"items"`
 }
 
-func parseError(c echo.Context, message string, error error) {
-	res := Response{Message: message}
-	c.JSON(http.StatusInternalServerError, res);
-	c.Logger().Error(error);
+type Category struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	ItemCount int    `json:"item_count"`
+}
+
+type Categories struct {
+	Categories []*Category `json:"categories"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type CountResponse struct {
+	Count int `json:"count"`
+}
+
+// BulkResponse reports the outcome of a bulk request. Rejected lists the
+// items left out when it was not strict.
+type BulkResponse struct {
+	Inserted int         `json:"inserted"`
+	Rejected []BulkError `json:"rejected,omitempty"`
+}
+
+// DeleteItemsRequest is the body of DELETE /items.
+type DeleteItemsRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+type DeleteItemsResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// maxDeleteItems caps the ids of one DELETE /items.
+const maxDeleteItems = 1000
+
+// BulkError is the ErrorResponse of a bulk request, extended with which
+// item was rejected.
+type BulkError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Index   int          `json:"index"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// ImportResponse reports the outcome of a CSV import.
+type ImportResponse struct {
+	Imported int           `json:"imported"`
+	Rejected []RejectedRow `json:"rejected"`
+}
+
+// RejectedRow is a CSV row that was not imported. Row counts from 1 and
+// includes the header.
+type RejectedRow struct {
+	Row    int          `json:"row"`
+	Reason string       `json:"reason"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// ItemEnvelope is the page of items returned by GET /items, with what
+// clients need to fetch the next one.
+type ItemEnvelope struct {
+	XMLName xml.Name `json:"-" xml:"items"`
+	Data    []*Item  `json:"data" xml:"item"`
+	Meta    PageMeta `json:"meta" xml:"meta"`
+}
+
+// PageMeta describes a page: Total is the number of items matching the
+// filters, Limit and Offset those the page was selected with.
+type PageMeta struct {
+	Total  int `json:"total" xml:"total,attr"`
+	Limit  int `json:"limit" xml:"limit,attr"`
+	Offset int `json:"offset" xml:"offset,attr"`
+	// NextCursor fetches the page after this one when passed as ?cursor.
+	// It is only set when iterating in the default order, by id, and the
+	// page is full.
+	NextCursor string `json:"next_cursor,omitempty" xml:"next_cursor,attr,omitempty"`
+}
+
+// encodeCursor returns the opaque cursor of the page after the item with
+// the given id.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// decodeCursor returns the id encoded by encodeCursor.
+func decodeCursor(cursor string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("cursor is invalid")
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("cursor is invalid")
+	}
+	return id, nil
+}
+
+// ItemPage is the body of GET /items before ItemEnvelope, still returned
+// with ?envelope=false.
+type ItemPage struct {
+	XMLName xml.Name `json:"-" xml:"items"`
+	Items   []*Item  `json:"items" xml:"item"`
+	Total   int      `json:"total" xml:"total,attr"`
+}
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+	// maxOffset bounds offset pagination, as SQLite steps over every
+	// skipped row. Cursors page through any number of items.
+	maxOffset = 100000
+
+	defaultRecent = 10
+	maxRecent     = 50
+)
+
+// requestLogFormat is the access log line written for every request. The
+// id matches the one attached to errors by logError.
+const requestLogFormat = `{"time":"${time_rfc3339_nano}","id":"${id}","method":"${method}",` +
+	`"path":"${path}","status":${status},"latency":${latency},"latency_human":"${latency_human}",` +
+	`"error":"${error}"}` + "\n"
+
+// logError logs err at error level along with the request id.
+func logError(c echo.Context, err error) {
+	c.Logger().Errorj(log.JSON{
+		"id":     c.Response().Header().Get(echo.HeaderXRequestID),
+		"method": c.Request().Method,
+		"path":   c.Request().URL.Path,
+		"error":  err.Error(),
+	})
+}
+
+// logPanic logs a panic recovered by the Recover middleware along with its
+// stack trace. The client only gets a plain 500.
+func logPanic(c echo.Context, err error, stack []byte) error {
+	c.Logger().Errorj(log.JSON{
+		"id":     c.Response().Header().Get(echo.HeaderXRequestID),
+		"method": c.Request().Method,
+		"path":   c.Request().URL.Path,
+		"error":  err.Error(),
+		"stack":  string(stack),
+	})
+	// err has been logged, so handleError must not log it again.
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error", nil)
+}
+
+var errInvalidPrice = errors.New("price must be a non-negative integer")
+
+// parsePrice parses a price form value. An empty value is a price of 0.
+func parsePrice(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	price, err := strconv.Atoi(value)
+	if err != nil || price < 0 {
+		return 0, errInvalidPrice
+	}
+	return price, nil
 }
 
 func root(c echo.Context) error {
@@ -47,168 +288,1636 @@ func root(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
-func getItems(c echo.Context) error {
-	data, err := os.ReadFile(itemsJson)
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+func getOpenAPISpec(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/yaml", openAPISpec)
+}
+
+// health reports whether the server is ready to serve requests.
+func (s *Server) health(c echo.Context) error {
+	if err := s.store.Ping(c.Request().Context()); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusServiceUnavailable, HealthResponse{Status: "unavailable"})
+	}
+	return c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// queryInt parses the named query parameter as a non-negative integer,
+// returning def when it is absent.
+func queryInt(c echo.Context, name string, def int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(value, "-") {
+		return 0, fmt.Errorf("%s is too large", name)
+	}
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// queryPriceRange parses the min_price and max_price query parameters. A
+// bound that is absent is nil.
+func queryPriceRange(c echo.Context) (min, max *int, err error) {
+	for _, bound := range []struct {
+		name string
+		dst  **int
+	}{{"min_price", &min}, {"max_price", &max}} {
+		if c.QueryParam(bound.name) == "" {
+			continue
+		}
+		n, err := queryInt(c, bound.name, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		*bound.dst = &n
+	}
+	if min != nil && max != nil && *min > *max {
+		return nil, nil, errors.New("min_price must not exceed max_price")
+	}
+	return min, max, nil
+}
+
+// maxIDs caps the ids of one GET /items?ids=.
+const maxIDs = 100
+
+// queryIDs parses the comma-separated ids query parameter, dropping
+// repeated ids. It returns nil when the parameter is absent.
+func queryIDs(c echo.Context) ([]int64, error) {
+	value := c.QueryParam("ids")
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) > maxIDs {
+		return nil, fmt.Errorf("ids must not list more than %d ids", maxIDs)
+	}
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, errors.New("ids must be a comma-separated list of positive integers")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// getItems answers with a page of items, from itemsCache when the same
+// page was asked for since the last write.
+func (s *Server) getItems(c echo.Context) error {
+	// Checked before the cache, which may hold a page the admin asked for.
+	if v, err := strconv.ParseBool(c.QueryParam("include_deleted")); err == nil && v && !s.isAdmin(c) {
+		return newAPIError(http.StatusForbidden, codeForbidden, "include_deleted needs the admin credentials", nil)
+	}
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	key := c.QueryParams().Encode()
+	if prefersXML(c.Request().Header.Get(echo.HeaderAccept)) {
+		key = "xml " + key
+	}
+	return s.itemsCache.serve(c, key, func() error { return s.listItems(c) })
+}
+
+func (s *Server) listItems(c echo.Context) error {
+	limit, err := queryInt(c, "limit", defaultLimit)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+	}
+	if offset > maxOffset {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery,
+			fmt.Sprintf("offset must be at most %d; page further with cursor", maxOffset), nil)
+	}
+
+	sort := c.QueryParam("sort")
+	if _, ok := sortColumns[sort]; sort != "" && !ok {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, "sort must be one of id, name, category", nil)
+	}
+	order := c.QueryParam("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, "order must be asc or desc", nil)
+	}
+
+	var since time.Time
+	if v := c.QueryParam("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "since must be an RFC 3339 timestamp", nil)
+		}
+	}
+
+	var includeDeleted bool
+	if v := c.QueryParam("include_deleted"); v != "" {
+		if includeDeleted, err = strconv.ParseBool(v); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "include_deleted must be true or false", nil)
+		}
+	}
+	minPrice, maxPrice, err := queryPriceRange(c)
 	if err != nil {
-		parseError(c, "Failed to read items.json", err)
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+	}
+	envelope := true
+	if v := c.QueryParam("envelope"); v != "" {
+		if envelope, err = strconv.ParseBool(v); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "envelope must be true or false", nil)
+		}
+	}
+
+	ids, err := queryIDs(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+	}
+
+	// Cursors resume iterating by id, which is stable while items are
+	// added and deleted, unlike offsets.
+	byID := (sort == "" || sort == "id") && order != "desc"
+	var afterID int64
+	if v := c.QueryParam("cursor"); v != "" {
+		if !byID {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "cursor only applies to the order by id, ascending", nil)
+		}
+		if offset != 0 {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "cursor and offset cannot be combined", nil)
+		}
+		if afterID, err = decodeCursor(v); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+		}
+	}
+
+	var (
+		items []*Item
+		total int
+	)
+	if ids != nil {
+		// The ids pick the items and their order, so the other filters,
+		// the sort order and pagination do not apply.
+		if items, err = s.store.GetByIDs(c.Request().Context(), ids); err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select items", err)
+		}
+		total, limit, offset = len(items), len(ids), 0
+	} else {
+		q := ItemQuery{
+			Category:       c.QueryParam("category"),
+			Sort:           sort,
+			Desc:           order == "desc",
+			Limit:          limit,
+			Offset:         offset,
+			AfterID:        afterID,
+			Since:          since,
+			IncludeDeleted: includeDeleted,
+			MinPrice:       minPrice,
+			MaxPrice:       maxPrice,
+		}
+		if items, total, err = s.store.GetAll(c.Request().Context(), q); err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select items", err)
+		}
+	}
+	meta := PageMeta{Total: total, Limit: limit, Offset: offset}
+	if ids == nil && byID && limit > 0 && len(items) == limit {
+		meta.NextCursor = encodeCursor(items[len(items)-1].ID)
+	}
+	var page any = ItemEnvelope{Data: items, Meta: meta}
+	if !envelope {
+		page = ItemPage{Items: items, Total: total}
+	}
+	if prefersXML(c.Request().Header.Get(echo.HeaderAccept)) {
+		return c.XML(http.StatusOK, page)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// prefersXML reports whether an Accept header ranks XML above JSON. JSON
+// wins ties, as well as headers accepting neither.
+func prefersXML(accept string) bool {
+	var jsonQ, xmlQ float64
+	for _, v := range parseAccept(accept) {
+		switch v.value {
+		case echo.MIMEApplicationJSON, "application/*", "*/*":
+			if v.q > jsonQ {
+				jsonQ = v.q
+			}
+		case echo.MIMEApplicationXML, echo.MIMETextXML:
+			if v.q > xmlQ {
+				xmlQ = v.q
+			}
+		}
+	}
+	return xmlQ > jsonQ
+}
+
+// acceptValue is one of the values of an Accept-style header, lower-cased,
+// with its q value.
+type acceptValue struct {
+	value string
+	q     float64
+}
+
+// parseAccept splits an Accept-style header, such as Accept or
+// Accept-Language, into its values, highest q value first. Values ranked
+// the same keep their order, and a missing or malformed q counts as 1.
+func parseAccept(header string) []acceptValue {
+	var values []acceptValue
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		values = append(values, acceptValue{value: value, q: q})
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].q > values[j].q })
+	return values
+}
+
+// exportItemsCSV streams every item as CSV.
+func (s *Server) exportItemsCSV(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	h.Set(echo.HeaderContentDisposition, `attachment; filename="items.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	err := w.Write([]string{"id", "name", "category", "price"})
+	if err == nil {
+		err = forEachItem(c.Request().Context(), s.db, func(item *Item) error {
+			return w.Write([]string{
+				strconv.FormatInt(item.ID, 10),
+				item.Name,
+				item.Category,
+				strconv.Itoa(item.Price),
+			})
+		})
+	}
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		// The status has already been sent, so all we can do is log and
+		// cut the response short.
+		logError(c, err)
+	}
+	return nil
+}
+
+func (s *Server) countItems(c echo.Context) error {
+	n, err := s.store.Count(c.Request().Context(), ItemQuery{Category: c.QueryParam("category")})
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to count items", err)
+	}
+	return c.JSON(http.StatusOK, CountResponse{Count: n})
+}
+
+// getRandomItem returns one item picked at random, optionally within a
+// category.
+func (s *Server) getRandomItem(c echo.Context) error {
+	item, err := selectRandomItem(c.Request().Context(), s.db, ItemQuery{Category: c.QueryParam("category")})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "no items", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+	return c.JSON(http.StatusOK, item)
+}
+
+// getRecentItems returns the n most recently created items, newest first.
+func (s *Server) getRecentItems(c echo.Context) error {
+	n, err := queryInt(c, "n", defaultRecent)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+	}
+	if n > maxRecent {
+		n = maxRecent
+	}
+	items, err := selectRecentItems(c.Request().Context(), s.db, n)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select items", err)
+	}
+	return c.JSON(http.StatusOK, Items{Items: items})
+}
+
+func (s *Server) getCategories(c echo.Context) error {
+	categories, err := selectCategories(c.Request().Context(), s.db)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select categories", err)
+	}
+	return c.JSON(http.StatusOK, Categories{Categories: categories})
+}
+
+// renameCategory renames a category. Items refer to it by id, so they all
+// follow.
+func (s *Server) renameCategory(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+	var req RenameCategoryRequest
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid request body", nil)
+	}
+	req.Name = sanitizeName(req.Name)
+	if err := c.Validate(&req); err != nil {
 		return err
 	}
-	return c.JSONBlob(http.StatusOK, data)
+
+	var category *Category
+	err = execWithRetry(c.Request().Context(), s.cfg, func() (err error) {
+		category, err = renameCategory(c.Request().Context(), s.db, id, req.Name)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeCategoryNotFound, "category not found", nil)
+	}
+	if isUniqueViolation(err) {
+		return newAPIError(http.StatusConflict, codeDuplicateCategory, fmt.Sprintf("category %q already exists", req.Name), nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to rename category", err)
+	}
+	return c.JSON(http.StatusOK, category)
 }
 
-func getHashedImage(c echo.Context) (string, error) {
-	imageFile, error := c.FormFile("image")
-	if error != nil {
-		parseError(c, "Failed to get image file", error)
-		return "", error
+func (s *Server) searchItemsByKeyword(c echo.Context) error {
+	keyword := c.QueryParam("keyword")
+	if keyword == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, "keyword is required", nil)
+	}
+	minPrice, maxPrice, err := queryPriceRange(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
 	}
 
-	src, err := imageFile.Open()
+	q := ItemQuery{Category: c.QueryParam("category"), MinPrice: minPrice, MaxPrice: maxPrice}
+	items, err := s.store.Search(c.Request().Context(), keyword, q)
 	if err != nil {
-		parseError(c, "Failed to open image file", error)
-		return "", err
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to search items", err)
 	}
-	defer src.Close()
+	return c.JSON(http.StatusOK, Items{Items: items})
+}
+
+const (
+	// headerIdempotencyKey makes POST /items safe to retry: a request with
+	// the key of an earlier one gets the earlier item back.
+	headerIdempotencyKey    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+	// idempotencyKeyTTL is how long keys are remembered.
+	idempotencyKeyTTL = 24 * time.Hour
+)
+
+// isJSONRequest reports whether the request body is JSON rather than a form.
+func isJSONRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+}
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, src); err != nil {
-		parseError(c, "Failed to hash image file", err)
-		return "", err
+// addItem creates an item from either a multipart form, which must include
+// an image, or a JSON body, which cannot carry one.
+func (s *Server) addItem(c echo.Context) error {
+	key := c.Request().Header.Get(headerIdempotencyKey)
+	if utf8.RuneCountInString(key) > maxIdempotencyKeyLength {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed,
+			fmt.Sprintf("%s must be at most %d characters", headerIdempotencyKey, maxIdempotencyKeyLength), nil)
+	}
+	dedup, err := s.dedupPolicy(c)
+	if err != nil {
+		return err
+	}
+	var dryRun bool
+	if v := c.QueryParam("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidQuery, "dry_run must be a boolean", nil)
+		}
 	}
+	since := time.Now().Add(-idempotencyKeyTTL)
+	if key != "" {
+		// Answer retries before saving their image again.
+		id, err := s.store.IdempotentItemID(c.Request().Context(), key, since)
+		if err == nil {
+			return s.replayItem(c, id)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to look up idempotency key", err)
+		}
+	}
+
+	var req AddItemRequest
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid request body", nil)
+	}
+	if sanitizeName(req.Category) == "" {
+		req.Category = s.cfg.DefaultCategory
+	}
+	if err := c.Validate(&req); err != nil {
+		return err
+	}
+	newItem := req.item()
+	newItem.OwnerID, _ = subject(c)
+
+	// The image is staged under a temporary name and only moved into place
+	// as the item is committed, so that neither is stored without the other.
+	var staged *stagedImage
+	defer func() { staged.discard() }()
+	if !isJSONRequest(c) {
+		imageFile, err := requiredImage(c)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			newItem.Image, _, err = prepareImage(s.cfg.ImageQuality, s.imageLimits(), imageFile)
+		} else if staged, err = stageImage(s.cfg.ImgDir, s.cfg.ImageQuality, s.imageLimits(), imageFile); err == nil {
+			newItem.Image = staged.Name
+		}
+		if err != nil {
+			return imageError(err)
+		}
+	}
+
+	if dryRun {
+		return s.answerDryRun(c, newItem, dedup)
+	}
+
+	opts := AddOptions{
+		Key:      key,
+		Since:    since,
+		Dedup:    dedup != dedupAllow,
+		MaxItems: s.cfg.MaxItems,
+		Actor:    s.actor(c),
+	}
+	if staged != nil {
+		opts.BeforeCommit = staged.commit
+	}
+	var (
+		id       int64
+		replayed bool
+	)
+	err = execWithRetry(c.Request().Context(), s.cfg, func() (err error) {
+		id, replayed, err = s.store.Add(c.Request().Context(), newItem, opts)
+		return err
+	})
+	var dup *duplicateItemError
+	if errors.As(err, &dup) {
+		return s.answerDuplicate(c, dup.ID, dedup)
+	}
+	if isUniqueViolation(err) {
+		return duplicateNameError(newItem.Name)
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		return s.quotaError()
+	}
+	if err != nil {
+		if staged != nil && !staged.Reused {
+			// The image may have been moved into place before the commit
+			// failed.
+			s.removeUnusedImage(c, staged.Name)
+		}
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to insert item", err)
+	}
+	if replayed {
+		// A concurrent request with the same key won the race.
+		return s.replayItem(c, id)
+	}
+
+	newItem.ID = id
+	s.events.publish(ItemEvent{Type: eventItemAdded, Item: newItem})
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("%s/items/%d", apiPrefix, id))
+	return c.JSON(http.StatusCreated, AddItemResponse{Item: newItem, ImageDeduplicated: staged != nil && staged.Reused})
+}
+
+// AddItemResponse is the item created by POST /items.
+type AddItemResponse struct {
+	*Item
+	// ImageDeduplicated reports that the uploaded image was already stored,
+	// e.g. for another item, and is shared rather than stored again.
+	ImageDeduplicated bool `json:"image_deduplicated"`
+}
+
+// quotaError is the error answering a request that would exceed
+// Config.MaxItems.
+func (s *Server) quotaError() error {
+	return newAPIError(http.StatusForbidden, codeQuotaExceeded,
+		fmt.Sprintf("the limit of %d items has been reached", s.cfg.MaxItems), nil)
+}
+
+// DryRunResponse is the item POST /items?dry_run=true would have created.
+type DryRunResponse struct {
+	*Item
+	DryRun bool `json:"dry_run"`
+}
+
+// answerDryRun answers a dry run of addItem once newItem passed validation,
+// without writing anything. Duplicates and a full quota are answered as
+// addItem would.
+func (s *Server) answerDryRun(c echo.Context, newItem *Item, dedup string) error {
+	if dedup != dedupAllow {
+		dups, _, err := s.store.GetAll(c.Request().Context(), ItemQuery{Name: newItem.Name, Category: newItem.Category, Limit: 1})
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to check for duplicates", err)
+		}
+		if len(dups) > 0 {
+			// Pass no image: the one of newItem was never saved.
+			return s.answerDuplicate(c, dups[0].ID, dedup)
+		}
+	}
+	if s.cfg.MaxItems > 0 {
+		n, err := s.store.Count(c.Request().Context(), ItemQuery{})
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to count items", err)
+		}
+		if n >= s.cfg.MaxItems {
+			return s.quotaError()
+		}
+	}
+	if s.cfg.RequireUniqueNames {
+		n, err := s.store.Count(c.Request().Context(), ItemQuery{Name: newItem.Name})
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to check for duplicates", err)
+		}
+		if n > 0 {
+			return duplicateNameError(newItem.Name)
+		}
+	}
+	newItem.CreatedAt = time.Now().UTC()
+	newItem.Version = 1
+	if newItem.AltText == "" {
+		newItem.AltText = newItem.Name
+	}
+	newItem.setImages("", "")
+	return c.JSON(http.StatusOK, DryRunResponse{Item: newItem, DryRun: true})
+}
+
+// duplicateNameError is the error answered when REQUIRE_UNIQUE_NAMES
+// rejects a write. name is empty when the item is not known.
+func duplicateNameError(name string) error {
+	msg := "items must have unique names"
+	if name != "" {
+		msg = fmt.Sprintf("an item named %q exists", name)
+	}
+	return newAPIError(http.StatusConflict, codeDuplicateName, msg, nil)
+}
+
+// dedupPolicy returns what addItem does with a duplicate: the dedup query
+// parameter picks between returning the existing item (true) and rejecting
+// the request (false), and Config.ItemDedup applies otherwise.
+func (s *Server) dedupPolicy(c echo.Context) (string, error) {
+	value := c.QueryParam("dedup")
+	if value == "" {
+		return s.cfg.ItemDedup, nil
+	}
+	dedup, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidQuery, "dedup must be a boolean", nil)
+	}
+	if dedup {
+		return dedupReturn, nil
+	}
+	return dedupReject, nil
+}
 
-	src.Seek(0, 0)
-	hashedImage := fmt.Sprintf("%x.jpg", hash.Sum(nil))
+// answerDuplicate answers an addItem that was not inserted because item id
+// has the same name and category.
+func (s *Server) answerDuplicate(c echo.Context, id int64, policy string) error {
+	if policy == dedupReject {
+		return newAPIError(http.StatusConflict, codeDuplicateItem,
+			fmt.Sprintf("item %d has the same name and category", id), nil)
+	}
 
-	dst, err := os.Create(path.Join(ImgDir, hashedImage))
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
 	if err != nil {
-		parseError(c, "Failed to create image file", err)
-		return "", err
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
 	}
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("%s/items/%d", apiPrefix, id))
+	return c.JSON(http.StatusOK, item)
+}
 
-	defer dst.Close()
-	if _, err := io.Copy(dst, src); err != nil {
-		parseError(c, "Failed to copy image file", err)
-		return "", err
+// replayItem answers a retried addItem with the item created by the first
+// request.
+func (s *Server) replayItem(c echo.Context, id int64) error {
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
 	}
 
-	return hashedImage ,nil
+	h := c.Response().Header()
+	h.Set(echo.HeaderLocation, fmt.Sprintf("%s/items/%d", apiPrefix, id))
+	h.Set("Idempotent-Replayed", "true")
+	return c.JSON(http.StatusCreated, item)
 }
 
-func addItem(c echo.Context) error {
-	data, error := os.ReadFile(itemsJson)
-	if error != nil {
-		parseError(c, "Notfound items.json", error)
-		return error
+// addItemsBulk inserts a JSON array of items, each checked against
+// itemSchema. By default nothing is stored if any item is rejected; with
+// strict=false the valid items are inserted and the others reported.
+func (s *Server) addItemsBulk(c echo.Context) error {
+	strict, err := parseStrict(c, true)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid JSON body", nil)
+	}
+	if len(req.Items) == 0 {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed, "items must not be empty", nil)
 	}
 
-	var items Items
-	newData := bytes.NewReader(data)
-	if error := json.NewDecoder(newData).Decode(&items); error != nil {
-		parseError(c, "Failed to newReader items.json", error)
-		return error
+	owner, _ := subject(c)
+	items := make([]*Item, 0, len(req.Items))
+	res := BulkResponse{}
+	for i, raw := range req.Items {
+		r, errs, err := validateItemJSON(raw)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to validate request", err)
+		}
+		if errs != nil {
+			rejected := BulkError{
+				Code:    codeValidationFailed,
+				Message: errs[0].Message,
+				Index:   i,
+				Errors:  errs,
+			}
+			if strict {
+				return c.JSON(http.StatusBadRequest, rejected)
+			}
+			res.Rejected = append(res.Rejected, rejected)
+			continue
+		}
+		// Images are uploaded separately; bulk items never reference one.
+		item := r.item()
+		item.OwnerID = owner
+		items = append(items, item)
+	}
+
+	if len(items) > 0 {
+		err := insertItems(c.Request().Context(), s.db, items, s.actor(c), s.cfg.MaxItems)
+		if isUniqueViolation(err) {
+			return duplicateNameError("")
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			return s.quotaError()
+		}
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to insert items", err)
+		}
+	}
+	res.Inserted = len(items)
+	return c.JSON(http.StatusCreated, res)
+}
+
+// parseStrict reads the strict query parameter, which chooses between
+// rejecting a whole batch and rejecting only its invalid entries.
+func parseStrict(c echo.Context, def bool) (bool, error) {
+	value := c.QueryParam("strict")
+	if value == "" {
+		return def, nil
+	}
+	strict, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, newAPIError(http.StatusBadRequest, codeInvalidQuery, "strict must be a boolean", nil)
+	}
+	return strict, nil
+}
+
+// importColumns are the columns expected by importItemsCSV, in order.
+var importColumns = []string{"name", "category", "price"}
+
+// isImportHeader reports whether record is the header row of an import.
+func isImportHeader(record []string) bool {
+	if len(record) != len(importColumns) {
+		return false
+	}
+	for i, col := range importColumns {
+		if !strings.EqualFold(strings.TrimSpace(record[i]), col) {
+			return false
+		}
+	}
+	return true
+}
+
+// importItemsCSV inserts the valid rows of an uploaded name,category,price
+// CSV file in one transaction and reports the rows it rejected. Rows are
+// checked against itemSchema. With strict=true nothing is inserted if any
+// row is rejected.
+func (s *Server) importItemsCSV(c echo.Context) error {
+	strict, err := parseStrict(c, false)
+	if err != nil {
+		return err
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeFileRequired, "CSV file is required", nil)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to open CSV file", err)
+	}
+	defer f.Close()
+
+	owner, _ := subject(c)
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	items := []*Item{}
+	res := ImportResponse{Rejected: []RejectedRow{}}
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidCSV, fmt.Sprintf("Invalid CSV on row %d", row), nil)
+		}
+		if row == 1 && isImportHeader(record) {
+			continue
+		}
+		if len(record) != len(importColumns) {
+			res.Rejected = append(res.Rejected, RejectedRow{
+				Row:    row,
+				Reason: fmt.Sprintf("expected %d columns, got %d", len(importColumns), len(record)),
+			})
+			continue
+		}
+		price, err := parsePrice(strings.TrimSpace(record[2]))
+		if err != nil {
+			res.Rejected = append(res.Rejected, RejectedRow{Row: row, Reason: err.Error()})
+			continue
+		}
+		name, category := sanitizeName(record[0]), sanitizeName(record[1])
+		errs, err := validateItemValue(map[string]any{
+			"name":     name,
+			"category": category,
+			"price":    price,
+		})
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to validate request", err)
+		}
+		if errs != nil {
+			res.Rejected = append(res.Rejected, RejectedRow{Row: row, Reason: errs[0].Message, Errors: errs})
+			continue
+		}
+		items = append(items, &Item{Name: name, Category: category, Price: price, OwnerID: owner})
+	}
+	if strict && len(res.Rejected) > 0 {
+		return c.JSON(http.StatusBadRequest, res)
+	}
+
+	if len(items) > 0 {
+		err := insertItems(c.Request().Context(), s.db, items, s.actor(c), s.cfg.MaxItems)
+		if isUniqueViolation(err) {
+			return duplicateNameError("")
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			return s.quotaError()
+		}
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to insert items", err)
+		}
+	}
+	res.Imported = len(items)
+	return c.JSON(http.StatusOK, res)
+}
+
+func parseID(c echo.Context) (int64, error) {
+	return strconv.ParseInt(c.Param("id"), 10, 64)
+}
+
+func (s *Server) getItem(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+	return c.JSON(http.StatusOK, item)
+}
+
+// updateItem changes the fields present in the form and leaves blank ones
+// as they are. If the form has a version, the update only applies to the
+// item at that version.
+func (s *Server) updateItem(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+	var version int
+	if v := c.FormValue("version"); v != "" {
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return newAPIError(http.StatusBadRequest, codeValidationFailed, "version must be a positive integer", nil)
+		}
 	}
 
 	name := c.FormValue("name")
 	category := c.FormValue("category")
-	hashedImage, error := getHashedImage(c)
-	if error != nil {
-		parseError(c, "Failed to get hashed image", error)
-		return error
+	price := c.FormValue("price")
+	description := c.FormValue("description")
+	altText := c.FormValue("alt_text")
+	imageFile, err := uploadedImage(c)
+	if err != nil {
+		return err
+	}
+	if name == "" && category == "" && price == "" && description == "" && altText == "" && imageFile == nil {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed, "no fields to update", nil)
 	}
 
-	newItem := Item{Name: name, Category: category, Image: hashedImage}
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
 
-	items.Items = append(items.Items, &newItem)
+	if name != "" {
+		item.Name = name
+	}
+	if category != "" {
+		item.Category = category
+	}
+	if price != "" {
+		if item.Price, err = parsePrice(price); err != nil {
+			return newAPIError(http.StatusBadRequest, codeValidationFailed, err.Error(), nil)
+		}
+	}
+	if description != "" {
+		item.Description = description
+	}
+	if altText != "" {
+		item.AltText = altText
+	}
+	prevImage := item.Image
+	if imageFile != nil {
+		name, err := s.storeImage(imageFile)
+		if err != nil {
+			return err
+		}
+		item.setPrimaryImage(name)
+	}
+	return s.saveItem(c, item, version, prevImage)
+}
 
-	updatedData, error := json.Marshal(items)
-	if error != nil {
-		parseError(c, "Failed to marshal items.json", error)
-		return error
+// patchItem changes the fields present in the body and leaves absent or
+// null ones as they are. Unlike updateItem, an empty string is a value. A
+// multipart body may replace the image too.
+func (s *Server) patchItem(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
 	}
 
-	if error := os.WriteFile(itemsJson, updatedData, 0644); error != nil {
-		parseError(c, "Failed to write items.json", error)
-		return error
+	var req PatchItemRequest
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid request body", nil)
+	}
+	imageFile, err := uploadedImage(c)
+	if err != nil {
+		return err
+	}
+	if req.empty() && imageFile == nil {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed, "no fields to update", nil)
+	}
+
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
 	}
 
-	message := fmt.Sprintf("item received: %s", name)
-	res := Response{Message: message}
+	var version int
+	if req.Version != nil {
+		if version = *req.Version; version < 1 {
+			return newAPIError(http.StatusBadRequest, codeValidationFailed, "version must be a positive integer", nil)
+		}
+	}
+	req.apply(item)
+	prevImage := item.Image
+	if imageFile != nil {
+		name, err := s.storeImage(imageFile)
+		if err != nil {
+			return err
+		}
+		item.setPrimaryImage(name)
+	}
+	return s.saveItem(c, item, version, prevImage)
+}
 
-	// http.StatusCreated(201) is also good choice.StatusOK
-  // but in that case, you need to implement and return a URL
-  //   that returns information on the posted item.
-	return c.JSON(http.StatusOK, res)
+// uploadedImage returns the image part of a multipart body, or nil if
+// there is none.
+func uploadedImage(c echo.Context) (*multipart.FileHeader, error) {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return nil, nil
+	}
+	imageFile, err := c.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid multipart body", nil)
+	}
+	return imageFile, nil
+}
+
+// requiredImage is uploadedImage for requests that must have an image. A
+// body without one is a client error told apart from a malformed body.
+func requiredImage(c echo.Context) (*multipart.FileHeader, error) {
+	imageFile, err := uploadedImage(c)
+	if err == nil && imageFile == nil {
+		err = newAPIError(http.StatusBadRequest, codeFileRequired, "Image file is required", nil)
+	}
+	return imageFile, err
+}
+
+// storeImage saves an uploaded image with saveImage and returns its name.
+func (s *Server) storeImage(imageFile *multipart.FileHeader) (string, error) {
+	name, _, err := saveImage(s.cfg.ImgDir, s.cfg.ImageQuality, s.imageLimits(), imageFile)
+	if err != nil {
+		return "", imageError(err)
+	}
+	return name, nil
+}
+
+func (s *Server) imageLimits() imageLimits {
+	return imageLimits{
+		MinWidth:  s.cfg.MinImageWidth,
+		MinHeight: s.cfg.MinImageHeight,
+		MaxWidth:  s.cfg.MaxImageWidth,
+		MaxHeight: s.cfg.MaxImageHeight,
+		MaxBytes:  s.cfg.MaxImageSize,
+	}
+}
+
+// imageError maps an error from saveImage or prepareImage to the APIError
+// to answer with.
+func imageError(err error) error {
+	var sizeErr *imageSizeError
+	switch {
+	case errors.Is(err, errUnsupportedImage):
+		return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedImage, "Image must be a JPEG, PNG or WebP file", nil)
+	case errors.Is(err, errInvalidImage):
+		return newAPIError(http.StatusBadRequest, codeInvalidImage, "Image file is corrupt", nil)
+	case errors.Is(err, errImageTooLarge):
+		return newAPIError(http.StatusRequestEntityTooLarge, codeImageTooLarge, "Image file is too large", nil)
+	case errors.As(err, &sizeErr):
+		// Capitalized like the other messages.
+		message := sizeErr.Error()
+		return newAPIError(http.StatusBadRequest, codeImageDimensions, strings.ToUpper(message[:1])+message[1:], nil)
+	}
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to save image file", err)
+}
+
+// saveItem validates and stores the changed item, answering with it. A
+// non-zero version is the one the client based its changes on. prevImage
+// is the image of the item before the request; whichever of it and a new
+// image the item does not end up with is removed if no item uses it.
+func (s *Server) saveItem(c echo.Context, item *Item, version int, prevImage string) (err error) {
+	if newImage := item.Image; newImage != prevImage {
+		defer func() {
+			if err != nil {
+				s.removeUnusedImage(c, newImage)
+			} else if prevImage != "" {
+				s.removeUnusedImage(c, prevImage)
+			}
+		}()
+	}
+
+	req := requestForItem(item)
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+	item.Name, item.Category, item.Description = req.Name, req.Category, req.Description
+	item.setAltText(req.AltText)
+
+	err = execWithRetry(c.Request().Context(), s.cfg, func() error {
+		return s.store.Update(c.Request().Context(), item, version, s.actor(c))
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if errors.Is(err, errVersionConflict) {
+		return newAPIError(http.StatusConflict, codeVersionConflict,
+			fmt.Sprintf("item is no longer at version %d", version), nil)
+	}
+	if isUniqueViolation(err) {
+		return duplicateNameError(item.Name)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to update item", err)
+	}
+	return c.JSON(http.StatusOK, item)
 }
 
-func getItemById(c echo.Context) error {
-	data, error := os.ReadFile(itemsJson)
-	if error != nil {
-		parseError(c, "Failed to read items.json", error)
-		return error
+// deleteItems deletes the items listed in the body in one transaction and
+// reports how many there were. Unknown ids are ignored. Users
+// authenticated by a token can only delete their own items.
+func (s *Server) deleteItems(c echo.Context) error {
+	var req DeleteItemsRequest
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid JSON body", nil)
+	}
+	if len(req.IDs) == 0 {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed, "ids must not be empty", nil)
+	}
+	if len(req.IDs) > maxDeleteItems {
+		return newAPIError(http.StatusBadRequest, codeValidationFailed,
+			fmt.Sprintf("ids must have at most %d entries", maxDeleteItems), nil)
+	}
+	var owner *string
+	if sub, ok := subject(c); ok {
+		owner = &sub
 	}
 
-	var items Items
-	newData := bytes.NewReader(data)
-	if error := json.NewDecoder(newData).Decode(&items); error != nil {
-		parseError(c,"Failed to newDecoder items.json", error)
-		return error
+	var (
+		deleted int
+		orphans []string
+	)
+	err := execWithRetry(c.Request().Context(), s.cfg, func() (err error) {
+		deleted, orphans, err = deleteItemsByID(c.Request().Context(), s.db, req.IDs, owner, s.cfg.SoftDelete, s.actor(c))
+		return err
+	})
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to delete items", err)
+	}
+	for _, orphan := range orphans {
+		if orphan != defaultImage {
+			s.removeImage(c, orphan)
+		}
 	}
+	return c.JSON(http.StatusOK, DeleteItemsResponse{Deleted: deleted})
+}
 
-	id := c.Param("id")
-	idInt, err := strconv.Atoi(id)
+func (s *Server) deleteItem(c echo.Context) error {
+	id, err := parseID(c)
 	if err != nil {
-		parseError(c, "Invalid ID format", err)
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+
+	var orphans []string
+	err = execWithRetry(c.Request().Context(), s.cfg, func() (err error) {
+		orphans, err = s.store.Delete(c.Request().Context(), id, s.actor(c))
 		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to delete item", err)
+	}
+	for _, orphan := range orphans {
+		// Items imported from items.json may refer to the shared default
+		// image.
+		if orphan != defaultImage {
+			s.removeImage(c, orphan)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// restoreItem undoes a soft delete.
+func (s *Server) restoreItem(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
 	}
 
-	if idInt <= 0 || idInt > len(items.Items) {
-		res := Response{Message: "Item not found"}
-		return c.JSON(http.StatusNotFound, res)
+	err = execWithRetry(c.Request().Context(), s.cfg, func() error {
+		return restoreItemByID(c.Request().Context(), s.db, id, s.actor(c))
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if isUniqueViolation(err) {
+		return newAPIError(http.StatusConflict, codeDuplicateName,
+			"an item with the same name was added since this one was deleted", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to restore item", err)
 	}
 
-	item := items.Items[idInt - 1]
+	item, err := selectItem(c.Request().Context(), s.db, id)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
 	return c.JSON(http.StatusOK, item)
 }
 
-func getImg(c echo.Context) error {
-	// Create image path
-	imgPath := path.Join(ImgDir, c.Param("imageFilename"))
+// removeUnusedImage removes an image saved for a request that did not
+// use it, unless it is the image of an item.
+func (s *Server) removeUnusedImage(c echo.Context, name string) {
+	if name == defaultImage {
+		return
+	}
+	// Not cancelled with the request, which may be over because it timed
+	// out, so that the image does not stay behind.
+	if used, err := s.store.ImageInUse(context.Background(), name); err != nil {
+		logError(c, err)
+	} else if !used {
+		s.removeImage(c, name)
+	}
+}
 
-	if !strings.HasSuffix(imgPath, ".jpg") {
-		res := Response{Message: "Image path does not end with .jpg"}
-		return c.JSON(http.StatusBadRequest, res)
+// removeImage deletes an image no item refers to any more, along with its
+// thumbnail. The item is already gone, so failures are only logged.
+func (s *Server) removeImage(c echo.Context, name string) {
+	imgPath := filepath.Join(s.cfg.ImgDir, name)
+	for _, p := range []string{imgPath, thumbnailPath(imgPath)} {
+		err := os.Remove(p)
+		if errors.Is(err, os.ErrNotExist) {
+			c.Logger().Debugf("Image already removed: %s", p)
+		} else if err != nil {
+			logError(c, err)
+		}
 	}
-	if _, err := os.Stat(imgPath); err != nil {
+}
+
+var (
+	errBadImagePath = errors.New("image path does not end with .jpg or .png")
+	errBadImageName = errors.New("image name is not a plain file name")
+)
+
+// cleanImageName returns the unescaped imageFilename param, rejecting
+// anything that could refer to a file outside the image directory.
+func cleanImageName(param string) (string, error) {
+	name, err := url.PathUnescape(param)
+	if err != nil {
+		return "", errBadImageName
+	}
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", errBadImageName
+	}
+	return name, nil
+}
+
+// defaultImage is served in place of images that do not exist.
+const defaultImage = "default.jpg"
+
+// imagePath returns the file to serve for the imageFilename path param,
+// falling back to the default image when it does not exist. found reports
+// whether the requested image itself was found. imgPath is empty when the
+// default image is missing too, in which case placeholderImage is served.
+func (s *Server) imagePath(c echo.Context) (imgPath string, found bool, err error) {
+	name, err := cleanImageName(c.Param("imageFilename"))
+	if err != nil {
+		return "", false, err
+	}
+	return s.resolveImage(c, name)
+}
+
+// resolveImage is imagePath for an image name already cleaned.
+func (s *Server) resolveImage(c echo.Context, name string) (imgPath string, found bool, err error) {
+	imgPath = filepath.Join(s.cfg.ImgDir, name)
+
+	if ext := filepath.Ext(imgPath); ext != ".jpg" && ext != ".png" {
+		return "", false, errBadImagePath
+	}
+	if _, err := os.Stat(imgPath); errors.Is(err, os.ErrNotExist) {
 		c.Logger().Debugf("Image not found: %s", imgPath)
-		imgPath = path.Join(ImgDir, "default.jpg")
+		defaultPath := filepath.Join(s.cfg.ImgDir, defaultImage)
+		if _, err := os.Stat(defaultPath); errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+		return defaultPath, false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return imgPath, true, nil
+}
+
+// placeholderImage is served when neither the requested image nor the
+// default image exists, so a deployment without images/default.jpg still
+// answers with an image. It already fits the thumbnail size.
+//
+//go:embed placeholder.png
+var placeholderImage []byte
+
+func servePlaceholder(c echo.Context) error {
+	// Set for HEAD requests too, which write no body to measure.
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(placeholderImage)))
+	return c.Blob(http.StatusOK, "image/png", placeholderImage)
+}
+
+// imageCacheControl is sent with stored images. Their names are content
+// hashes, so a name always refers to the same bytes.
+const imageCacheControl = "public, max-age=31536000, immutable"
+
+// itemImageCacheControl is sent with the image of an item served by id,
+// which changes when the item's image is replaced. Clients revalidate it
+// with the ETag, which is cheap.
+const itemImageCacheControl = "no-cache"
+
+// setImageCacheHeaders marks the response for imgPath as cacheable with
+// cacheControl. c.File then answers If-None-Match with 304 Not Modified on
+// its own.
+func setImageCacheHeaders(c echo.Context, imgPath, cacheControl string) {
+	name := path.Base(imgPath)
+	h := c.Response().Header()
+	h.Set(echo.HeaderCacheControl, cacheControl)
+	h.Set("ETag", `"`+strings.TrimSuffix(name, path.Ext(name))+`"`)
+}
+
+func (s *Server) getImg(c echo.Context) error {
+	imgPath, found, err := s.imagePath(c)
+	if errors.Is(err, errBadImageName) {
+		return newAPIError(http.StatusBadRequest, codeInvalidImageName, "Invalid image file name", nil)
+	}
+	if errors.Is(err, errBadImagePath) {
+		return newAPIError(http.StatusBadRequest, codeInvalidImageName, "Image path does not end with .jpg or .png", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to stat image file", err)
+	}
+	return serveImage(c, imgPath, found, imageCacheControl)
+}
+
+// getItemImage serves the primary image of an item, so clients need not
+// know its file name, or the default image if the item has none.
+func (s *Server) getItemImage(c echo.Context) error {
+	id, err := parseID(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid ID format", nil)
+	}
+	item, err := s.store.GetByID(c.Request().Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, codeItemNotFound, "item not found", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select item", err)
+	}
+	name := item.Image
+	if name == "" {
+		name = defaultImage
+	}
+	imgPath, found, err := s.resolveImage(c, name)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to stat image file", err)
+	}
+	// The default image is not named by its hash, so its name makes no ETag.
+	return serveImage(c, imgPath, found && item.Image != "", itemImageCacheControl)
+}
+
+// serveImage serves the image at imgPath, or placeholderImage if it is
+// empty, as found by imagePath.
+func serveImage(c echo.Context, imgPath string, found bool, cacheControl string) error {
+	if imgPath == "" {
+		return servePlaceholder(c)
+	}
+
+	// Trust the file contents rather than its name.
+	contentType, err := detectContentType(imgPath)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to read image file", err)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	// The placeholder must not be cached under a name the real image may
+	// be uploaded as later.
+	if found {
+		setImageCacheHeaders(c, imgPath, cacheControl)
 	}
 	return c.File(imgPath)
 }
 
-func main() {
+// getThumbnail serves a downscaled copy of the image, generating and
+// caching it next to the original on first request.
+func (s *Server) getThumbnail(c echo.Context) error {
+	imgPath, found, err := s.imagePath(c)
+	if errors.Is(err, errBadImageName) {
+		return newAPIError(http.StatusBadRequest, codeInvalidImageName, "Invalid image file name", nil)
+	}
+	if errors.Is(err, errBadImagePath) {
+		return newAPIError(http.StatusBadRequest, codeInvalidImageName, "Image path does not end with .jpg or .png", nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to stat image file", err)
+	}
+	if imgPath == "" {
+		return servePlaceholder(c)
+	}
+
+	thumbPath := thumbnailPath(imgPath)
+	if err := ensureThumbnail(c.Request().Context(), imgPath, thumbPath, s.cfg.ImageQuality); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to create thumbnail", err)
+	}
+	if found {
+		setImageCacheHeaders(c, thumbPath, imageCacheControl)
+	}
+	return c.File(thumbPath)
+}
+
+// apiPrefix is prepended to every API route.
+const apiPrefix = "/api/v1"
+
+// redirectToAPI redirects a request for a deprecated unversioned path to
+// its apiPrefix equivalent. Clients may replay a 301 as a GET, so requests
+// with other methods get a 308, which keeps the method and body.
+func redirectToAPI(c echo.Context) error {
+	u := *c.Request().URL
+	u.Path = apiPrefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = apiPrefix + u.RawPath
+	}
+	status := http.StatusMovedPermanently
+	if m := c.Request().Method; m != http.MethodGet && m != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	c.Response().Header().Set("Deprecation", "true")
+	return c.Redirect(status, u.RequestURI())
+}
+
+// shutdownTimeout bounds how long in-flight requests may take to finish once
+// a shutdown signal is received.
+const shutdownTimeout = 10 * time.Second
+
+// longLived reports whether the route of c may legitimately outlast
+// Config.RequestTimeout: files, which are as slow as the client reading
+// them, and the streams of events. Thumbnails are not, as making one is
+// work of the server's.
+func longLived(c echo.Context) bool {
+	switch strings.TrimPrefix(c.Path(), apiPrefix) {
+	case "/ws", "/items/stream", "/items.csv", "/items/:id/image", "/image/:imageFilename":
+		return true
+	}
+	return false
+}
+
+// gzipMinLength is the smallest response worth compressing.
+const gzipMinLength = 1024
+
+// newEcho returns an Echo instance with the middleware and routes of s.
+// ipExtractor returns how the client address is found, for the rate limit
+// and the access log. X-Forwarded-For is only believed when it was set by
+// one of the trusted proxies, otherwise a client could pick a new address
+// for every request.
+func ipExtractor(trusted []*net.IPNet) echo.IPExtractor {
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	// Loopback, link-local and private addresses are trusted by default,
+	// so they are turned off to trust only what is configured.
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipNet := range trusted {
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+func newEcho(s *Server) *echo.Echo {
 	e := echo.New()
 
 	// Middleware
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Logger.SetLevel(log.INFO)
+	e.Use(middleware.RequestID())
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Format: requestLogFormat}))
+	m := newMetrics()
+	e.Use(m.middleware)
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		DisableStackAll: true,
+		LogErrorFunc:    logPanic,
+	}))
+	e.Use(middleware.BodyLimit(s.cfg.MaxUploadSize))
+	e.Logger.SetLevel(s.cfg.LogLevel)
+	e.Validator = newValidator()
+	e.HTTPErrorHandler = handleError
+	e.IPExtractor = ipExtractor(s.cfg.TrustedProxies)
 
-	frontURL := os.Getenv("FRONT_URL")
-	if frontURL == "" {
-		frontURL = "http://localhost:3000"
-	}
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{frontURL},
-		AllowMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+		AllowOrigins:     s.cfg.FrontURLs,
+		AllowCredentials: s.cfg.CORSAllowCredentials,
+		AllowMethods:     []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete},
+		AllowHeaders:     s.cfg.CORSAllowHeaders,
+		ExposeHeaders:    s.cfg.CORSExposeHeaders,
+		MaxAge:           int(s.cfg.CORSMaxAge.Seconds()),
+	}))
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		MinLength: gzipMinLength,
+		// JPEGs are already compressed, WebSockets have their own framing
+		// and events must not wait in a compression buffer.
+		Skipper: func(c echo.Context) bool {
+			switch c.Path() {
+			case apiPrefix + "/ws", apiPrefix + "/items/stream", apiPrefix + "/items/:id/image":
+				return true
+			}
+			return strings.HasPrefix(c.Path(), apiPrefix+"/image/")
+		},
 	}))
+	if s.cfg.RequestTimeout > 0 {
+		e.Use(middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+			Timeout: s.cfg.RequestTimeout,
+			Skipper: longLived,
+			ErrorHandler: func(err error, c echo.Context) error {
+				// A query cut short may fail with an error of its own, such
+				// as a transaction already rolled back, so the deadline is
+				// checked too.
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+					return newAPIError(http.StatusServiceUnavailable, codeTimeout, "Request timed out", err)
+				}
+				return err
+			},
+		}))
+	}
+
+	s.readOnly.Store(s.cfg.ReadOnly)
+
+	// write is applied to every route that modifies items. trackWrites
+	// comes last so that requests turned away before the handler don't
+	// count as writes.
+	guard := []echo.MiddlewareFunc{
+		s.rejectReadOnly,
+		middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+			Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+				Rate:  rate.Limit(s.cfg.WriteRateLimit),
+				Burst: s.cfg.WriteRateBurst,
+			}),
+		}),
+	}
+	write := guard
+	if auth := s.writeAuth(); auth != nil {
+		write = append(write[:len(write):len(write)], auth)
+	}
+	// admin is applied instead of write to the routes changing many items
+	// at once. They need the admin credentials when there are any, and
+	// token users only get to their own items.
+	admin := guard[:len(guard):len(guard)]
+	if s.cfg.AdminUser != "" {
+		admin = append(admin, s.adminAuth())
+	} else if s.cfg.JWTSecret != "" {
+		admin = append(admin, s.userAuth())
+	}
+	admin = append(admin, s.trackWrites)
+	// own is applied to the write routes of one item instead of write.
+	own := append(write[:len(write):len(write)], s.requireOwner, s.trackWrites)
+	write = append(write[:len(write):len(write)], s.trackWrites)
 
 	// Routes
 	e.GET("/", root)
-	e.POST("/items", addItem)
-	e.GET("/items", getItems)
-	e.GET("/items/:id", getItemById)
-	e.GET("/image/:imageFilename", getImg)
+	e.GET("/metrics", m.handler())
+	api := e.Group(apiPrefix)
+	api.GET("/health", s.health)
+	api.GET("/maintenance", s.getMaintenance)
+	// Read-only mode stops every seller, so only the admin switches it;
+	// without admin credentials it is set by READ_ONLY alone. The write
+	// middleware is left out so that the mode can be left again.
+	if s.cfg.AdminUser != "" {
+		api.PUT("/maintenance", s.setMaintenance, s.adminAuth())
+	}
+	api.GET("/openapi.yaml", getOpenAPISpec)
+	api.GET("/schemas/item.json", getItemSchema)
+	if s.cfg.JWTSecret != "" {
+		api.POST("/login", s.login)
+	}
+	api.POST("/items", s.addItem, write...)
+	api.GET("/items", s.getItems)
+	api.GET("/items/count", s.countItems)
+	api.GET("/items/stream", s.streamItems)
+	api.GET("/items/:id", s.getItem)
+	api.PUT("/items/:id", s.updateItem, own...)
+	api.PATCH("/items/:id", s.patchItem, own...)
+	api.DELETE("/items/:id", s.deleteItem, own...)
+	api.GET("/search", s.searchItemsByKeyword)
+	// The other routes need more than ItemStore offers, so they are only
+	// served by the sqlite backend.
+	if s.db != nil {
+		api.POST("/items/bulk", s.addItemsBulk, write...)
+		api.POST("/items/import", s.importItemsCSV, write...)
+		api.DELETE("/items", s.deleteItems, admin...)
+		api.GET("/items/random", s.getRandomItem)
+		api.GET("/items/recent", s.getRecentItems)
+		api.GET("/items.csv", s.exportItemsCSV)
+		api.GET("/items/:id/images", s.getItemImages)
+		api.POST("/items/:id/images", s.addItemImage, own...)
+		api.POST("/items/:id/images/batch", s.addItemImages, own...)
+		api.DELETE("/items/:id/images/:imageFilename", s.deleteItemImage, own...)
+		api.POST("/items/:id/restore", s.restoreItem, own...)
+		// The audit log names who changed what, so it is for the admin only,
+		// as is the overview of the catalog.
+		var audit []echo.MiddlewareFunc
+		if s.cfg.AdminUser != "" {
+			audit = append(audit, s.adminAuth())
+		}
+		api.GET("/audit", s.getAuditLog, audit...)
+		api.GET("/stats", s.getStats, audit...)
+		api.GET("/categories", s.getCategories)
+		// Categories are shared by the items of every seller, so only the
+		// admin renames them.
+		if s.cfg.AdminUser != "" {
+			api.PUT("/categories/:id", s.renameCategory, admin...)
+		}
+	}
+	api.GET("/ws", s.watchItems)
+	api.GET("/image/:imageFilename", s.getImg)
+	// c.File answers HEAD with the headers of GET and no body.
+	api.HEAD("/image/:imageFilename", s.getImg)
+	api.GET("/image/:imageFilename/thumbnail", s.getThumbnail)
+	api.GET("/items/:id/image", s.getItemImage)
+	api.HEAD("/items/:id/image", s.getItemImage)
+
+	// The unversioned paths predate apiPrefix. Keep them working for a
+	// transition period.
+	for _, r := range e.Routes() {
+		if legacy, ok := strings.CutPrefix(r.Path, apiPrefix); ok {
+			e.Add(r.Method, legacy, redirectToAPI)
+		}
+	}
+
+	return e
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if created, err := ensureImgDir(cfg.ImgDir); err != nil {
+		log.Fatal(err)
+	} else if created {
+		log.Infof("Created image directory %s", cfg.ImgDir)
+	}
+	s := &Server{cfg: cfg}
+	if cfg.StorageBackend == storageJSON {
+		if s.store, err = newJSONStore(cfg.ItemsJSON, cfg.RequireUniqueNames); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if s.db, err = openDB(cfg); err != nil {
+			log.Fatal(err)
+		}
+		defer s.db.Close()
+		s.store = &SQLiteStore{db: s.db, softDelete: cfg.SoftDelete}
+	}
+	e := newEcho(s)
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if _, ok := parseLogLevel(value); !ok {
+			e.Logger.Warnf("LOG_LEVEL: unknown level %q, using info", value)
+		}
+	}
+	if cfg.AdminUser == "" && cfg.JWTSecret == "" {
+		e.Logger.Warn("ADMIN_USER and JWT_SECRET are unset; anyone can modify items")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var maintenance sync.WaitGroup
+	if cfg.VacuumInterval > 0 && s.db != nil {
+		maintenance.Add(1)
+		go func() {
+			defer maintenance.Done()
+			s.runMaintenance(ctx, cfg.VacuumInterval, e.Logger)
+		}()
+	}
+
+	// Shutdown waits for requests to finish, so end the streams of events.
+	e.Server.RegisterOnShutdown(s.events.close)
 
 	// Start server
-	e.Logger.Fatal(e.Start(":9000"))
+	go func() {
+		if err := e.Start(cfg.Addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	e.Logger.Info("shutting down")
+
+	// Let in-flight requests finish before the database is closed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Error(err)
+	}
+	maintenance.Wait()
 }
@@ -0,0 +1,2510 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newTestServer returns a Server backed by a fresh database and image
+// directory inside t.TempDir().
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestServerWithJSON(t, "")
+}
+
+// newTestServerWithJSON is like newTestServer but first writes itemsJSON,
+// if non-empty, to the legacy items.json imported on first boot.
+func newTestServerWithJSON(t *testing.T, itemsJSON string) *Server {
+	t.Helper()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg.ImgDir = filepath.Join(dir, "images")
+	cfg.DBPath = filepath.Join(dir, "mercari.sqlite3")
+	cfg.ItemsJSON = filepath.Join(dir, "items.json")
+	cfg.WriteRateLimit = 1000
+	cfg.WriteRateBurst = 1000
+
+	if err := os.Mkdir(cfg.ImgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ImgDir, "default.jpg"), testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if itemsJSON != "" {
+		if err := os.WriteFile(cfg.ItemsJSON, []byte(itemsJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Server{cfg: cfg, store: &SQLiteStore{db: db, softDelete: cfg.SoftDelete}, db: db}
+}
+
+var testImage = func() []byte {
+	data, err := os.ReadFile(filepath.Join("..", "images", "default.jpg"))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}()
+
+// newAddItemBody builds the multipart body of a POST /items request. The
+// image part is omitted when image is nil.
+func newAddItemBody(t *testing.T, name, category string, image []byte) (body *bytes.Buffer, contentType string) {
+	t.Helper()
+
+	body = &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("name", name)
+	w.WriteField("category", category)
+	if image != nil {
+		part, err := w.CreateFormFile("image", "image.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(image)
+	}
+	w.Close()
+	return body, w.FormDataContentType()
+}
+
+// newAddItemRequest builds a multipart POST /items request for a handler.
+func newAddItemRequest(t *testing.T, name, category string, image []byte) *http.Request {
+	t.Helper()
+
+	body, contentType := newAddItemBody(t, name, category, image)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/items", body)
+	req.Header.Set(echo.HeaderContentType, contentType)
+	return req
+}
+
+func TestAddItem(t *testing.T) {
+	cases := []struct {
+		name        string
+		itemName    string
+		category    string
+		image       []byte
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{"valid", "jacket", "fashion", testImage, http.StatusCreated, "", ""},
+		{"missing name", "", "fashion", testImage, http.StatusBadRequest, codeValidationFailed, "name is required"},
+		{"missing category", "jacket", " ", testImage, http.StatusBadRequest, codeValidationFailed, "category is required"},
+		{"missing file", "jacket", "fashion", nil, http.StatusBadRequest, codeFileRequired, "Image file is required"},
+		{"not an image", "jacket", "fashion", []byte("plain text"), http.StatusUnsupportedMediaType, codeUnsupportedImage, "Image must be a JPEG, PNG or WebP file"},
+		{"corrupt image", "jacket", "fashion", placeholderImage[:64], http.StatusBadRequest, codeInvalidImage, "Image file is corrupt"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			rec := httptest.NewRecorder()
+			newEcho(s).ServeHTTP(rec, newAddItemRequest(t, tc.itemName, tc.category, tc.image))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if tc.wantStatus != http.StatusCreated {
+				var res ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if res.Code != tc.wantCode || res.Message != tc.wantMessage {
+					t.Errorf("error = %s %q, want %s %q", res.Code, res.Message, tc.wantCode, tc.wantMessage)
+				}
+				return
+			}
+
+			var item Item
+			if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil {
+				t.Fatal(err)
+			}
+			if item.ID == 0 || item.Name != tc.itemName || item.Category != tc.category || item.Image == "" {
+				t.Errorf("item = %+v", item)
+			}
+			if got, want := rec.Header().Get(echo.HeaderLocation), fmt.Sprintf("/api/v1/items/%d", item.ID); got != want {
+				t.Errorf("Location = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAddItemDryRun(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	post := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, contentType := newAddItemBody(t, "jacket", "fashion", placeholderImage)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/items"+query, body)
+		req.Header.Set(echo.HeaderContentType, contentType)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("?dry_run=true")
+	var res DryRunResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if !res.DryRun || res.Name != "jacket" || filepath.Ext(res.Image) != ".jpg" {
+		t.Errorf("response = %s", rec.Body)
+	}
+	if n, err := countItems(context.Background(), s.db, ItemQuery{}); err != nil || n != 0 {
+		t.Errorf("items after dry run = %d, %v; want 0", n, err)
+	}
+	if entries, err := os.ReadDir(s.cfg.ImgDir); err != nil || len(entries) != 1 {
+		t.Errorf("images after dry run = %v, %v; want only the default", entries, err)
+	}
+
+	if rec := post(""); rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := post("?dry_run=true&dedup=false"); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate dry run: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestImageQuality(t *testing.T) {
+	cases := []struct {
+		image, jpeg string
+		want        int
+		wantErr     bool
+	}{
+		{"", "", 85, false},
+		{"70", "", 70, false},
+		{"", "60", 60, false},
+		{"70", "60", 70, false},
+		{"0", "", 0, true},
+		{"", "101", 0, true},
+	}
+	for _, tc := range cases {
+		t.Setenv("IMAGE_QUALITY", tc.image)
+		t.Setenv("JPEG_QUALITY", tc.jpeg)
+		cfg, err := loadConfig()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("IMAGE_QUALITY=%q JPEG_QUALITY=%q: no error", tc.image, tc.jpeg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("IMAGE_QUALITY=%q JPEG_QUALITY=%q: %v", tc.image, tc.jpeg, err)
+		} else if cfg.ImageQuality != tc.want {
+			t.Errorf("IMAGE_QUALITY=%q JPEG_QUALITY=%q: quality = %d, want %d", tc.image, tc.jpeg, cfg.ImageQuality, tc.want)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	cases := []struct {
+		host, port string
+		want       string
+		wantErr    bool
+	}{
+		{"", "", ":9000", false},
+		{"127.0.0.1", "8080", "127.0.0.1:8080", false},
+		{"::1", "65535", "[::1]:65535", false},
+		{"", "0", "", true},
+		{"", "65536", "", true},
+		{"", "http", "", true},
+	}
+	for _, tc := range cases {
+		t.Setenv("HOST", tc.host)
+		t.Setenv("PORT", tc.port)
+		cfg, err := loadConfig()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("HOST=%q PORT=%q: no error", tc.host, tc.port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("HOST=%q PORT=%q: %v", tc.host, tc.port, err)
+		} else if cfg.Addr != tc.want {
+			t.Errorf("HOST=%q PORT=%q: addr = %q, want %q", tc.host, tc.port, cfg.Addr, tc.want)
+		}
+	}
+}
+
+func TestUpdateItemImage(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	serve := func(req *http.Request) *Item {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+			t.Fatalf("%s: status = %d, body = %s", req.Method, rec.Code, rec.Body)
+		}
+		var item Item
+		if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+		return &item
+	}
+	update := func(method, name, category string, image []byte) *Item {
+		t.Helper()
+		body, contentType := newAddItemBody(t, name, category, image)
+		req := httptest.NewRequest(method, "/api/v1/items/1", body)
+		req.Header.Set(echo.HeaderContentType, contentType)
+		return serve(req)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(s.cfg.ImgDir, name))
+		return err == nil
+	}
+
+	added := serve(newAddItemRequest(t, "jacket", "fashion", testImage))
+	put := update(http.MethodPut, "", "", placeholderImage)
+	if put.Image == added.Image || put.Name != "jacket" || !reflect.DeepEqual(put.Images, []string{put.Image}) {
+		t.Errorf("after PUT: item = %+v", put)
+	}
+	if exists(added.Image) || !exists(put.Image) {
+		t.Errorf("after PUT: old image exists = %v, new image exists = %v", exists(added.Image), exists(put.Image))
+	}
+
+	patched := update(http.MethodPatch, "cap", "fashion", testImage)
+	if patched.Image != added.Image || patched.Name != "cap" {
+		t.Errorf("after PATCH: item = %+v", patched)
+	}
+	if exists(put.Image) {
+		t.Error("after PATCH: replaced image still exists")
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/items/1", strings.NewReader(`{"price":5}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if item := serve(req); item.Image != added.Image || item.Price != 5 {
+		t.Errorf("after PATCH without an image: item = %+v", item)
+	}
+}
+
+func TestImageDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 32, 16))); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name        string
+		env         map[string]string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"within", map[string]string{"MAX_IMAGE_WIDTH": "32", "MIN_IMAGE_HEIGHT": "16"}, http.StatusCreated, ""},
+		{"too wide", map[string]string{"MAX_IMAGE_WIDTH": "31"}, http.StatusBadRequest, "Image is 32x16 pixels, larger than the maximum of 31x4000"},
+		{"too short", map[string]string{"MIN_IMAGE_HEIGHT": "17"}, http.StatusBadRequest, "Image is 32x16 pixels, smaller than the minimum of 16x17"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			rec := httptest.NewRecorder()
+			newEcho(newTestServer(t)).ServeHTTP(rec, newAddItemRequest(t, "jacket", "fashion", buf.Bytes()))
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d, body = %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if tc.wantStatus == http.StatusCreated {
+				return
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Code != codeImageDimensions || res.Message != tc.wantMessage {
+				t.Errorf("error = %s %q, want %s %q", res.Code, res.Message, codeImageDimensions, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, tc := range []struct{ w, h, wantW, wantH int }{
+		{400, 100, 200, 50},
+		{100, 100, 100, 100},
+		{4000, 16, 200, 1},
+		{16, 4000, 1, 200},
+	} {
+		got := resize(image.NewNRGBA(image.Rect(0, 0, tc.w, tc.h)), thumbnailSize).Bounds()
+		if got.Dx() != tc.wantW || got.Dy() != tc.wantH {
+			t.Errorf("resize(%dx%d) = %dx%d, want %dx%d", tc.w, tc.h, got.Dx(), got.Dy(), tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestAltText(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	add := func(altText string) Item {
+		t.Helper()
+		body := &bytes.Buffer{}
+		w := multipart.NewWriter(body)
+		w.WriteField("name", "jacket")
+		w.WriteField("category", "fashion")
+		if altText != "" {
+			w.WriteField("alt_text", altText)
+		}
+		part, _ := w.CreateFormFile("image", "image.jpg")
+		part.Write(testImage)
+		w.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/items", body)
+		req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var item Item
+		if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return item
+	}
+
+	if item := add("A blue denim jacket\n"); item.AltText != "A blue denim jacket" {
+		t.Errorf("alt_text = %q, want the one uploaded, sanitized", item.AltText)
+	}
+	item := add("")
+	if item.AltText != "jacket" {
+		t.Errorf("alt_text = %q, want the name", item.AltText)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/v1/items/%d", item.ID), strings.NewReader(`{"alt_text":"A red jacket"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("patch: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if item.AltText != "A red jacket" {
+		t.Errorf("alt_text after PATCH = %q, want %q", item.AltText, "A red jacket")
+	}
+}
+
+func TestAddItemDeduplicatesImage(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	for i, want := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, newAddItemRequest(t, fmt.Sprintf("jacket %d", i), "fashion", testImage))
+		var res AddItemResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		if res.ImageDeduplicated != want {
+			t.Errorf("upload %d: image_deduplicated = %v, want %v", i, res.ImageDeduplicated, want)
+		}
+	}
+	entries, err := os.ReadDir(s.cfg.ImgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// default.jpg and the image shared by both items.
+	if len(entries) != 2 {
+		t.Errorf("image directory has %d files, want 2", len(entries))
+	}
+}
+
+func TestAddItemImageCommittedWithItem(t *testing.T) {
+	t.Setenv("MAX_ITEMS", "1")
+	s := newTestServer(t)
+	e := newEcho(s)
+	images := func() []string {
+		entries, err := os.ReadDir(s.cfg.ImgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, newAddItemRequest(t, "jacket", "fashion", testImage))
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	// Only the committed image, next to default.jpg, and no temporary file.
+	want := []string{defaultImage, item.Image}
+	sort.Strings(want)
+	if got := images(); !reflect.DeepEqual(got, want) {
+		t.Errorf("image directory = %v, want %v", got, want)
+	}
+
+	// The quota rejects the item, so its image must not be kept.
+	other := append(bytes.Clone(testImage), 0)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, newAddItemRequest(t, "shirt", "fashion", other))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, body = %s, want 403", rec.Code, rec.Body)
+	}
+	if got := images(); !reflect.DeepEqual(got, want) {
+		t.Errorf("image directory = %v after a rejected item, want %v", got, want)
+	}
+}
+
+func TestAddItemConvertsToJPEG(t *testing.T) {
+	// A PNG transparent on the left, which must come out white, and red
+	// on the right.
+	src := image.NewNRGBA(image.Rect(0, 0, 32, 16))
+	for x := 16; x < 32; x++ {
+		for y := 0; y < 16; y++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t)
+	rec := httptest.NewRecorder()
+	newEcho(s).ServeHTTP(rec, newAddItemRequest(t, "jacket", "fashion", buf.Bytes()))
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if filepath.Ext(item.Image) != ".jpg" {
+		t.Fatalf("image = %s, want a .jpg", item.Image)
+	}
+	f, err := os.Open(filepath.Join(s.cfg.ImgDir, item.Image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("stored image is not a JPEG: %v", err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+		t.Errorf("transparent pixel = %v, want white", img.At(0, 0))
+	}
+}
+
+func TestEnsureImgDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "images", "nested")
+	if created, err := ensureImgDir(dir); err != nil || !created {
+		t.Fatalf("missing dir: created = %v, err = %v", created, err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("dir was not created: %v", err)
+	}
+	if created, err := ensureImgDir(dir); err != nil || created {
+		t.Errorf("existing dir: created = %v, err = %v", created, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "images")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureImgDir(file); err == nil {
+		t.Error("file: err = nil, want an error")
+	}
+}
+
+func TestGetItems(t *testing.T) {
+	cases := []struct {
+		name      string
+		itemsJSON string
+		query     string
+		wantNames []string
+		wantTotal int
+	}{
+		{"no items.json", "", "", []string{}, 0},
+		{"empty items.json", `{"items":[]}`, "", []string{}, 0},
+		{
+			"imported items",
+			`{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"}]}`,
+			"", []string{"jacket", "shoes"}, 2,
+		},
+		{
+			"paginated",
+			`{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"}]}`,
+			"?limit=1&offset=1", []string{"shoes"}, 2,
+		},
+		{
+			"price range",
+			`{"items":[{"name":"jacket","category":"fashion","price":500},{"name":"shoes","category":"fashion","price":1000},` +
+				`{"name":"hat","category":"fashion","price":5000},{"name":"bag","category":"fashion","price":6000}]}`,
+			"?min_price=1000&max_price=5000", []string{"shoes", "hat"}, 2,
+		},
+		{
+			"ids",
+			`{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"},{"name":"hat","category":"fashion"}]}`,
+			"?ids=3,1,9,3&limit=1&category=none", []string{"hat", "jacket"}, 2,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServerWithJSON(t, tc.itemsJSON)
+			rec := httptest.NewRecorder()
+			newEcho(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items"+tc.query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+			}
+			var page ItemEnvelope
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Data == nil {
+				t.Fatal("data is null, want an array")
+			}
+			names := []string{}
+			for _, item := range page.Data {
+				names = append(names, item.Name)
+			}
+			if !reflect.DeepEqual(names, tc.wantNames) {
+				t.Errorf("names = %v, want %v", names, tc.wantNames)
+			}
+			if page.Meta.Total != tc.wantTotal {
+				t.Errorf("total = %d, want %d", page.Meta.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestGetItemsInvalidPriceRange(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	for _, query := range []string{"min_price=-1", "max_price=abc", "min_price=10&max_price=5"} {
+		for _, prefix := range []string{"/api/v1/items?", "/api/v1/search?keyword=jacket&"} {
+			target := prefix + query
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("GET %s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestGetItemsCache(t *testing.T) {
+	s := newTestServerWithJSON(t, `{"items":[{"name":"jacket","category":"fashion"}]}`)
+	e := newEcho(s)
+	total := func(accept string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/items", nil)
+		req.Header.Set(echo.HeaderAccept, accept)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		var page ItemEnvelope
+		if accept == echo.MIMEApplicationXML {
+			if err := xml.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page.Meta.Total
+	}
+
+	if n := total(echo.MIMEApplicationJSON); n != 1 {
+		t.Fatalf("total = %d, want 1", n)
+	}
+	// Bypassing the write routes leaves the cached response in place.
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "shoes", Category: "fashion"}, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := total(echo.MIMEApplicationJSON); n != 1 {
+		t.Errorf("total = %d, want the cached 1", n)
+	}
+	if n := total(echo.MIMEApplicationXML); n != 2 {
+		t.Errorf("XML total = %d, want 2 as it is cached apart", n)
+	}
+
+	// A write that fails changes nothing, so the cache is kept.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/items", strings.NewReader(`{"category":"fashion"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("add without a name: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if n := total(echo.MIMEApplicationJSON); n != 1 {
+		t.Errorf("total after a failed write = %d, want the cached 1", n)
+	}
+	if s.lastWrite.Load() != 0 {
+		t.Error("a failed write was recorded as the last write")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/items", strings.NewReader(`{"name":"hat","category":"fashion"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if s.lastWrite.Load() == 0 {
+		t.Error("the write was not recorded")
+	}
+	if n := total(echo.MIMEApplicationJSON); n != 3 {
+		t.Errorf("total after a write = %d, want 3", n)
+	}
+}
+
+func TestGetItemsPaginationBounds(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	cases := []struct {
+		query       string
+		wantStatus  int
+		wantLimit   int
+		wantMessage string
+	}{
+		{"limit=0", http.StatusOK, 0, ""},
+		{fmt.Sprintf("limit=%d", maxLimit+1), http.StatusOK, maxLimit, ""},
+		{fmt.Sprintf("offset=%d", maxOffset), http.StatusOK, defaultLimit, ""},
+		{fmt.Sprintf("offset=%d", maxOffset+1), http.StatusBadRequest, 0, fmt.Sprintf("offset must be at most %d; page further with cursor", maxOffset)},
+		{"offset=999999999999999999", http.StatusBadRequest, 0, fmt.Sprintf("offset must be at most %d; page further with cursor", maxOffset)},
+		{"offset=99999999999999999999", http.StatusBadRequest, 0, "offset is too large"},
+		{"limit=9223372036854775808", http.StatusBadRequest, 0, "limit is too large"},
+		{"limit=-1", http.StatusBadRequest, 0, "limit must be a non-negative integer"},
+		{"offset=-99999999999999999999", http.StatusBadRequest, 0, "offset must be a non-negative integer"},
+		{"limit=1e3", http.StatusBadRequest, 0, "limit must be a non-negative integer"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items?"+tc.query, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tc.query, rec.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus == http.StatusOK {
+			var page ItemEnvelope
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || page.Meta.Limit != tc.wantLimit {
+				t.Errorf("%s: body = %s, want limit %d", tc.query, rec.Body, tc.wantLimit)
+			}
+			continue
+		}
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Code != codeInvalidQuery || res.Message != tc.wantMessage {
+			t.Errorf("%s: body = %s, want %s %q", tc.query, rec.Body, codeInvalidQuery, tc.wantMessage)
+		}
+	}
+}
+
+func TestGetItemsInvalidIDs(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	tooMany := strings.TrimSuffix(strings.Repeat("1,", maxIDs+1), ",")
+	for _, ids := range []string{"1,abc", "1,,2", "0", "-1", tooMany} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items?ids="+ids, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("ids=%s: status = %d, want %d", ids, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetRecentItems(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < maxRecent+2; i++ {
+		if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: fmt.Sprintf("item %d", i), Category: "misc"}, AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := newEcho(s)
+
+	cases := []struct {
+		query   string
+		wantLen int
+		wantID  int64
+	}{
+		{"", defaultRecent, maxRecent + 2},
+		{"?n=3", 3, maxRecent + 2},
+		{"?n=1000", maxRecent, maxRecent + 2},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items/recent"+tc.query, nil))
+		var res Items
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", tc.query, rec.Code, rec.Body)
+		}
+		if len(res.Items) != tc.wantLen || res.Items[0].ID != tc.wantID || res.Items[1].ID != tc.wantID-1 {
+			t.Errorf("%s: got %d items from id %d, want %d newest first from id %d", tc.query, len(res.Items), res.Items[0].ID, tc.wantLen, tc.wantID)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items/recent?n=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("n=-1: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetItemsCursor(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 5; i++ {
+		if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: fmt.Sprintf("item %d", i), Category: "misc"}, AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := newEcho(s)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items?"+query, nil))
+		return rec
+	}
+
+	var seen []int64
+	query := "limit=2"
+	for pages := 0; query != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("cursors do not end")
+		}
+		rec := get(query)
+		var page ItemEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", query, rec.Code, rec.Body)
+		}
+		for _, item := range page.Data {
+			seen = append(seen, item.ID)
+		}
+		if pages == 0 {
+			// Offsets would now skip an item.
+			if err := softDeleteItemByID(context.Background(), s.db, 1, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		query = ""
+		if page.Meta.NextCursor != "" {
+			query = "limit=2&cursor=" + page.Meta.NextCursor
+		}
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("iterated %v, want %v", seen, want)
+	}
+
+	cursor := encodeCursor(2)
+	for _, query := range []string{"cursor=abc", "cursor=" + encodeCursor(0), "sort=name&cursor=" + cursor, "order=desc&cursor=" + cursor, "offset=1&cursor=" + cursor} {
+		if rec := get(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetItemsIncludeDeleted(t *testing.T) {
+	s := newTestServerWithJSON(t, `{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"}]}`)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	e := newEcho(s)
+	if err := softDeleteItemByID(context.Background(), s.db, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	get := func(user, pass string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/items?include_deleted=true", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("admin", "secret")
+	var page ItemEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("admin: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(page.Data) != 2 || page.Data[0].ID != 1 {
+		t.Errorf("admin: items = %+v, want the deleted item 1 among 2", page.Data)
+	}
+
+	// The admin's page is cached by now and must not be served to others.
+	for _, creds := range [][2]string{{"", ""}, {"admin", "wrong"}} {
+		rec := get(creds[0], creds[1])
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusForbidden || res.Code != codeForbidden {
+			t.Errorf("%q: status = %d, body = %s, want 403 %s", creds[0], rec.Code, rec.Body, codeForbidden)
+		}
+	}
+}
+
+func TestGetItemsEnvelope(t *testing.T) {
+	const itemsJSON = `{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"}]}`
+	e := newEcho(newTestServerWithJSON(t, itemsJSON))
+	get := func(target string) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, body = %s", target, rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	var page ItemEnvelope
+	if err := json.Unmarshal(get("/api/v1/items?limit=500&offset=1"), &page); err != nil {
+		t.Fatal(err)
+	}
+	if want := (PageMeta{Total: 2, Limit: maxLimit, Offset: 1}); page.Meta != want {
+		t.Errorf("meta = %+v, want %+v", page.Meta, want)
+	}
+
+	var old map[string]json.RawMessage
+	if err := json.Unmarshal(get("/api/v1/items?envelope=false"), &old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old["items"]; !ok || string(old["total"]) != "2" || len(old) != 2 {
+		t.Errorf("envelope=false: body = %v, want items and total", old)
+	}
+}
+func TestAddItemsBulkSchema(t *testing.T) {
+	const body = `{"items":[{"name":"jacket","category":"fashion","price":100},{"name":" ","price":-1,"colour":"red"}]}`
+	cases := []struct {
+		query        string
+		wantCode     int
+		wantInserted int
+	}{
+		{"", http.StatusBadRequest, 0},
+		{"?strict=false", http.StatusCreated, 1},
+	}
+	wantErrs := []FieldError{
+		{"category", "category is required"},
+		{"colour", "colour is not a known field"},
+		{"name", "name is required"},
+		{"price", "price: must be >= 0 but found -1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			s := newTestServer(t)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/items/bulk"+tc.query, strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			newEcho(s).ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status = %d, want %d, body = %s", rec.Code, tc.wantCode, rec.Body)
+			}
+			var rejected BulkError
+			if tc.wantCode == http.StatusCreated {
+				var res BulkResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if res.Inserted != tc.wantInserted || len(res.Rejected) != 1 {
+					t.Fatalf("response = %+v, want %d inserted and 1 rejected", res, tc.wantInserted)
+				}
+				rejected = res.Rejected[0]
+			} else if err := json.Unmarshal(rec.Body.Bytes(), &rejected); err != nil {
+				t.Fatal(err)
+			}
+			if rejected.Index != 1 || !reflect.DeepEqual(rejected.Errors, wantErrs) {
+				t.Errorf("rejected = %+v, want index 1 with %+v", rejected, wantErrs)
+			}
+
+			count, err := countItems(context.Background(), s.db, ItemQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tc.wantInserted {
+				t.Errorf("items in database = %d, want %d", count, tc.wantInserted)
+			}
+		})
+	}
+}
+
+func TestItemSchemaMaxLength(t *testing.T) {
+	// item.schema.json is served as is, so its limits are written out and
+	// must be kept in step with the maxname validation.
+	var schema struct {
+		Properties map[string]struct {
+			MaxLength int `json:"maxLength"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(itemSchemaJSON, &schema); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"name", "category"} {
+		if got := schema.Properties[field].MaxLength; got != maxNameLength {
+			t.Errorf("maxLength of %s = %d, want maxNameLength (%d)", field, got, maxNameLength)
+		}
+	}
+}
+
+func TestAddItemIdempotencyKey(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/items", strings.NewReader(`{"name":"jacket","category":"fashion"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(headerIdempotencyKey, "add-jacket")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var item Item
+		if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("request %d: status = %d, body = %s", i+1, rec.Code, rec.Body)
+		}
+		ids = append(ids, item.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("ids = %v, want the same item twice", ids)
+	}
+	if n, err := countItems(context.Background(), s.db, ItemQuery{}); err != nil || n != 1 {
+		t.Errorf("items in database = %d (%v), want 1", n, err)
+	}
+}
+
+func TestAddItemDedup(t *testing.T) {
+	cases := []struct {
+		policy     string
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{dedupAllow, "", http.StatusCreated, 2},
+		{dedupReject, "", http.StatusConflict, 1},
+		{dedupReturn, "", http.StatusOK, 1},
+		{dedupAllow, "?dedup=true", http.StatusOK, 1},
+		{dedupReturn, "?dedup=false", http.StatusConflict, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy+tc.query, func(t *testing.T) {
+			s := newTestServer(t)
+			s.cfg.ItemDedup = tc.policy
+			e := newEcho(s)
+			var ids []int64
+			for i, wantStatus := range []int{http.StatusCreated, tc.wantStatus} {
+				body, contentType := newAddItemBody(t, "jacket", "fashion", testImage)
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/items"+tc.query, body)
+				req.Header.Set(echo.HeaderContentType, contentType)
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				if rec.Code != wantStatus {
+					t.Fatalf("request %d: status = %d, want %d, body = %s", i, rec.Code, wantStatus, rec.Body)
+				}
+				var item Item
+				json.Unmarshal(rec.Body.Bytes(), &item)
+				ids = append(ids, item.ID)
+			}
+			if tc.wantStatus == http.StatusOK && ids[1] != ids[0] {
+				t.Errorf("returned item %d, want the existing item %d", ids[1], ids[0])
+			}
+
+			count, err := countItems(context.Background(), s.db, ItemQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tc.wantCount {
+				t.Errorf("items in database = %d, want %d", count, tc.wantCount)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := newTestServerWithJSON(t, `{"items":[{"name":"jacket","category":"fashion"},{"name":"shoes","category":"fashion"},{"name":"tent","category":"outdoor"}]}`)
+	e := newEcho(s)
+	get := func() Stats {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		var stats Stats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := get()
+	if stats.TotalItems != 3 || stats.TotalCategories != 2 || stats.LatestItemAt == nil {
+		t.Errorf("stats = %+v", stats)
+	}
+	counts := map[string]int{}
+	for _, category := range stats.Categories {
+		counts[category.Name] = category.ItemCount
+	}
+	if want := map[string]int{"fashion": 2, "outdoor": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("item counts = %v, want %v", counts, want)
+	}
+
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "cap", Category: "hats"}, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := get(); stats.TotalItems != 3 {
+		t.Errorf("total within the TTL = %d, want the cached 3", stats.TotalItems)
+	}
+	s.stats.expires = time.Time{}
+	if stats := get(); stats.TotalItems != 4 || stats.TotalCategories != 3 {
+		t.Errorf("stats after the TTL = %+v", stats)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	e := newEcho(s)
+	serve := func(method, target, body string, auth bool) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	steps := []struct {
+		method, target, body string
+		wantStatus           int
+	}{
+		{http.MethodPost, "/api/v1/items", `{"name":"jacket","category":"fashion"}`, http.StatusCreated},
+		{http.MethodPatch, "/api/v1/items/1", `{"price":100}`, http.StatusOK},
+		{http.MethodDelete, "/api/v1/items/1", "", http.StatusNoContent},
+		{http.MethodPost, "/api/v1/items/1/restore", "", http.StatusOK},
+	}
+	for _, step := range steps {
+		if rec := serve(step.method, step.target, step.body, true); rec.Code != step.wantStatus {
+			t.Fatalf("%s %s: status = %d, body = %s", step.method, step.target, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := serve(http.MethodGet, "/api/v1/audit?item_id=1", "", false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/audit", "", true); rec.Code != http.StatusBadRequest {
+		t.Errorf("without item_id: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := serve(http.MethodGet, "/api/v1/audit?item_id=1", "", true)
+	var log AuditLog
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var ops []string
+	for _, entry := range log.Entries {
+		if entry.ItemID != 1 || entry.Actor != "admin" || entry.CreatedAt.IsZero() {
+			t.Errorf("entry = %+v", entry)
+		}
+		ops = append(ops, entry.Operation)
+	}
+	if want := []string{auditCreate, auditUpdate, auditDelete, auditRestore}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("operations = %v, want %v", ops, want)
+	}
+}
+
+func TestRequireUniqueNames(t *testing.T) {
+	t.Setenv("REQUIRE_UNIQUE_NAMES", "true")
+	s := newTestServer(t)
+	e := newEcho(s)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(http.MethodPost, "/api/v1/items", `{"name":"jacket","category":"fashion"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodPost, "/api/v1/items", `{"name":"shoes","category":"fashion"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	cases := []struct {
+		method, target, body string
+	}{
+		{http.MethodPost, "/api/v1/items", `{"name":"jacket","category":"outdoor"}`},
+		{http.MethodPost, "/api/v1/items?dry_run=true", `{"name":"jacket","category":"outdoor"}`},
+		{http.MethodPatch, "/api/v1/items/2", `{"name":"jacket"}`},
+	}
+	for _, tc := range cases {
+		rec := serve(tc.method, tc.target, tc.body)
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusConflict || res.Code != codeDuplicateName {
+			t.Errorf("%s %s: status = %d, body = %s, want 409 %s", tc.method, tc.target, rec.Code, rec.Body, codeDuplicateName)
+		}
+	}
+
+	// The index cannot be created over names already taken twice.
+	if err := setupUniqueNames(s.db, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "jacket", Category: "outdoor"}, AddOptions{}); err != nil {
+		t.Fatalf("insert without the index: %v", err)
+	}
+	if err := setupUniqueNames(s.db, true); err == nil {
+		t.Error("setupUniqueNames succeeded over duplicate names")
+	}
+}
+
+func TestRenameCategory(t *testing.T) {
+	s := newTestServerWithJSON(t, `{"items":[{"name":"jacket","category":"fashon"},{"name":"shoes","category":"fashon"},{"name":"tent","category":"outdoor"}]}`)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	s.cfg.JWTSecret = "jwt-secret"
+	e := newEcho(s)
+	serveAs := func(method, target, body, auth string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	admin := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serveAs(method, target, body, admin)
+	}
+
+	categories, err := selectCategories(context.Background(), s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	for _, category := range categories {
+		if category.Name == "fashon" {
+			id = category.ID
+		}
+	}
+	target := fmt.Sprintf("/api/v1/categories/%d", id)
+
+	// Any seller can get a token, so one must not rename a category.
+	token := "Bearer " + userToken(t, e, "alice")
+	if rec := serveAs(http.MethodPut, target, `{"name":"fashion"}`, token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("rename with a user token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec := serve(http.MethodPut, target, `{"name":" fashion "}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var category Category
+	if err := json.Unmarshal(rec.Body.Bytes(), &category); err != nil {
+		t.Fatal(err)
+	}
+	if category != (Category{ID: id, Name: "fashion", ItemCount: 2}) {
+		t.Errorf("category = %+v", category)
+	}
+	for _, itemID := range []int64{1, 2} {
+		if item, err := s.store.GetByID(context.Background(), itemID); err != nil || item.Category != "fashion" {
+			t.Errorf("item %d: category = %v, err = %v, want fashion", itemID, item, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		target, body string
+		status       int
+		code         string
+	}{
+		{target, `{"name":"outdoor"}`, http.StatusConflict, codeDuplicateCategory},
+		{target, `{"name":" "}`, http.StatusBadRequest, codeValidationFailed},
+		{"/api/v1/categories/999", `{"name":"other"}`, http.StatusNotFound, codeCategoryNotFound},
+	} {
+		rec := serve(http.MethodPut, tc.target, tc.body)
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != tc.status || res.Code != tc.code {
+			t.Errorf("PUT %s %s: status = %d, body = %s, want %d %s", tc.target, tc.body, rec.Code, rec.Body, tc.status, tc.code)
+		}
+	}
+}
+
+func TestDefaultCategory(t *testing.T) {
+	post := func(e *echo.Echo, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/items", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without DEFAULT_CATEGORY, category stays required.
+	if rec := post(newEcho(newTestServer(t)), `{"name":"jacket"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unset: status = %d, body = %s, want 400", rec.Code, rec.Body)
+	}
+
+	// The default is held to the limit of the category of a request.
+	long := strings.Repeat("a", maxNameLength+1)
+	t.Setenv("DEFAULT_CATEGORY", long)
+	if _, err := loadConfig(); err == nil {
+		t.Errorf("loadConfig accepted a DEFAULT_CATEGORY of %d characters", len(long))
+	}
+	t.Setenv("DEFAULT_CATEGORY", "")
+	rec := post(newEcho(newTestServer(t)), `{"name":"jacket","category":"`+long+`"}`)
+	if want := fmt.Sprintf("category must be at most %d characters", maxNameLength); !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("long category: status = %d, body = %s, want %q", rec.Code, rec.Body, want)
+	}
+
+	t.Setenv("DEFAULT_CATEGORY", " misc\t")
+	e := newEcho(newTestServer(t))
+	for body, want := range map[string]string{
+		`{"name":"jacket"}`:                   "misc",
+		`{"name":"shirt","category":" "}`:     "misc",
+		`{"name":"hat","category":"fashion"}`: "fashion",
+	} {
+		rec := post(e, body)
+		var item Item
+		if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+			t.Errorf("%s: status = %d, body = %s", body, rec.Code, rec.Body)
+			continue
+		}
+		if item.Category != want {
+			t.Errorf("%s: category = %q, want %q", body, item.Category, want)
+		}
+	}
+}
+
+func TestExecWithRetry(t *testing.T) {
+	s := newTestServer(t)
+	// Fail at once on a lock rather than after _busy_timeout, on the one
+	// connection the pragma is set on.
+	s.db.SetMaxOpenConns(1)
+	if _, err := s.db.Exec("PRAGMA busy_timeout = 0"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite3", "file:"+s.cfg.DBPath+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	// lock holds the write lock of the database through another connection
+	// until the returned function is called.
+	lock := func() func() error {
+		t.Helper()
+		tx, err := other.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO categories (name) VALUES ('lock')"); err != nil {
+			t.Fatal(err)
+		}
+		return tx.Rollback
+	}
+	attempts := 0
+	insert := func() error {
+		attempts++
+		_, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "jacket", Category: "fashion"}, AddOptions{})
+		return err
+	}
+
+	cfg := *s.cfg
+	cfg.DBMaxRetries, cfg.DBRetryDelay = 2, time.Millisecond
+	unlock := lock()
+	if err := execWithRetry(context.Background(), &cfg, insert); !isBusy(err) || attempts != 3 {
+		t.Errorf("err = %v after %d attempts, want busy after 3", err, attempts)
+	}
+	unlock()
+
+	// The lock is released while the write waits to retry.
+	attempts = 0
+	cfg.DBMaxRetries, cfg.DBRetryDelay = 5, 20*time.Millisecond
+	unlock = lock()
+	time.AfterFunc(30*time.Millisecond, func() { unlock() })
+	if err := execWithRetry(context.Background(), &cfg, insert); err != nil || attempts < 2 {
+		t.Errorf("err = %v after %d attempts, want success after a retry", err, attempts)
+	}
+	if n, err := countItems(context.Background(), s.db, ItemQuery{}); err != nil || n != 1 {
+		t.Errorf("items in database = %d (%v), want 1", n, err)
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	t.Setenv("MAX_ITEMS", "2")
+	e := newEcho(newTestServer(t))
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	codes := make(chan int, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- serve(http.MethodPost, "/api/v1/items", fmt.Sprintf(`{"name":"item %d","category":"misc"}`, i)).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if want := map[int]int{http.StatusCreated: 2, http.StatusForbidden: 3}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("statuses = %v, want %v", counts, want)
+	}
+
+	rec := serve(http.MethodPost, "/api/v1/items/bulk", `{"items":[{"name":"more","category":"misc"}]}`)
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusForbidden || res.Code != codeQuotaExceeded {
+		t.Errorf("bulk: status = %d, body = %s, want 403 %s", rec.Code, rec.Body, codeQuotaExceeded)
+	}
+	// A dry run tells of the quota too.
+	rec = serve(http.MethodPost, "/api/v1/items?dry_run=true", `{"name":"more","category":"misc"}`)
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusForbidden || res.Code != codeQuotaExceeded {
+		t.Errorf("dry run: status = %d, body = %s, want 403 %s", rec.Code, rec.Body, codeQuotaExceeded)
+	}
+
+	// Deleted items make room.
+	if rec := serve(http.MethodDelete, "/api/v1/items/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodPost, "/api/v1/items", `{"name":"again","category":"misc"}`); rec.Code != http.StatusCreated {
+		t.Errorf("add after delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestJSONStore(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", storageJSON)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ItemsJSON = filepath.Join(t.TempDir(), "items.json")
+	if err := os.WriteFile(cfg.ItemsJSON, []byte(`{"items":[{"name":"jacket","category":"fashion"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newJSONStore(cfg.ItemsJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newEcho(&Server{cfg: cfg, store: st})
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(http.MethodPost, "/api/v1/items", `{"name":"shoes","category":"fashion","price":30}`); rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodPatch, "/api/v1/items/1", `{"price":20}`); rec.Code != http.StatusOK {
+		t.Fatalf("patch: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodDelete, "/api/v1/items/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/items/2", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get deleted: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/categories", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("categories: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// The changes are in the file.
+	st, err = newJSONStore(cfg.ItemsJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, total, err := st.GetAll(context.Background(), ItemQuery{Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || items[0].ID != 1 || items[0].Price != 20 || items[0].Version != 2 {
+		t.Errorf("reloaded items = %+v", items)
+	}
+	if id, _, err := st.Add(context.Background(), &Item{Name: "cap", Category: "fashion"}, AddOptions{}); err != nil || id != 3 {
+		t.Errorf("add after reload: id = %d, err = %v, want 3", id, err)
+	}
+}
+
+func TestUpdateItemVersion(t *testing.T) {
+	e := newEcho(newTestServerWithJSON(t, `{"items":[{"name":"jacket","category":"fashion"}]}`))
+	put := func(form string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/items/1", strings.NewReader(form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := put("price=100&version=1")
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("first update: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if item.Version != 2 {
+		t.Errorf("version = %d, want 2", item.Version)
+	}
+
+	// A second client still holding version 1 must not overwrite it.
+	rec = put("price=200&version=1")
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stale update: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Code != codeVersionConflict {
+		t.Errorf("stale update: body = %s", rec.Body)
+	}
+
+	if rec := put("price=300"); rec.Code != http.StatusOK {
+		t.Errorf("update without version: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestItemImages(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	body, contentType := newAddItemBody(t, "jacket", "fashion", testImage)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/items", body)
+	req.Header.Set(echo.HeaderContentType, contentType)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Add a PNG as the second image.
+	imgBody := &bytes.Buffer{}
+	w := multipart.NewWriter(imgBody)
+	w.WriteField("alt_text", "The jacket, folded\n")
+	part, err := w.CreateFormFile("image", "extra.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(placeholderImage)
+	w.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/items/1/images", imgBody)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var images ItemImages
+	if err := json.Unmarshal(rec.Body.Bytes(), &images); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("add image: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(images.Images) != 2 || images.Images[0] != item.Image {
+		t.Fatalf("images = %v, want %s first and one more", images.Images, item.Image)
+	}
+	wantAltTexts := []string{"jacket", "The jacket, folded"}
+	if !reflect.DeepEqual(images.AltTexts, wantAltTexts) {
+		t.Errorf("alt_texts = %q, want %q", images.AltTexts, wantAltTexts)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items/1", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || !reflect.DeepEqual(item.AltTexts, wantAltTexts) {
+		t.Errorf("item alt_texts = %q, want %q", item.AltTexts, wantAltTexts)
+	}
+	req = httptest.NewRequest(http.MethodPatch, "/api/v1/items/1", strings.NewReader(`{"alt_text":"A blue jacket"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || !reflect.DeepEqual(item.AltTexts, []string{"A blue jacket", "The jacket, folded"}) {
+		t.Errorf("alt_texts after PATCH = %q, want the primary one changed", item.AltTexts)
+	}
+	extra := images.Images[1]
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/items/1/images/"+extra, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete image: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.ImgDir, extra)); !os.IsNotExist(err) {
+		t.Errorf("unused image %s was not removed: %v", extra, err)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/items/1/images/"+item.Image, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("delete primary image: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// An image the database fails to take is not left behind.
+	before, err := os.ReadDir(s.cfg.ImgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Close()
+	imgBody.Reset()
+	w = multipart.NewWriter(imgBody)
+	if part, err = w.CreateFormFile("image", "extra.png"); err != nil {
+		t.Fatal(err)
+	}
+	part.Write(placeholderImage)
+	w.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/items/1/images", imgBody)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("add image without a database: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if after, err := os.ReadDir(s.cfg.ImgDir); err != nil || len(after) != len(before) {
+		t.Errorf("image directory has %d files after a failed add, want %d", len(after), len(before))
+	}
+}
+
+func TestAddItemImages(t *testing.T) {
+	t.Setenv("MAX_IMAGE_SIZE", "4KB")
+	s := newTestServer(t)
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "jacket", Category: "fashion"}, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for name, data := range map[string][]byte{"a.png": placeholderImage, "b.txt": []byte("plain text"), "c.jpg": testImage} {
+		part, err := w.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	w.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/items/1/images/batch", body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	newEcho(s).ServeHTTP(rec, req)
+
+	var res BatchImagesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if res.Added != 1 || len(res.Images) != 1 {
+		t.Errorf("added %d, images = %v, want the PNG only", res.Added, res.Images)
+	}
+	if !reflect.DeepEqual(res.AltTexts, []string{"jacket"}) {
+		t.Errorf("alt_texts = %q, want the name of the item", res.AltTexts)
+	}
+	rejected := map[string]string{}
+	for _, r := range res.Rejected {
+		rejected[r.File] = r.Code
+	}
+	if want := map[string]string{"b.txt": codeUnsupportedImage, "c.jpg": codeImageTooLarge}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected = %v, want %v", rejected, want)
+	}
+}
+
+func TestAddItemImageRequired(t *testing.T) {
+	s := newTestServer(t)
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "jacket", Category: "fashion"}, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e := newEcho(s)
+	withImage, withImageType := newAddItemBody(t, "jacket", "fashion", testImage)
+	withoutImage, withoutImageType := newAddItemBody(t, "jacket", "fashion", nil)
+
+	cases := []struct {
+		name        string
+		body        io.Reader
+		contentType string
+		wantStatus  int
+		wantCode    string
+	}{
+		{"present", withImage, withImageType, http.StatusCreated, ""},
+		{"missing", withoutImage, withoutImageType, http.StatusBadRequest, codeFileRequired},
+		{"not multipart", strings.NewReader(`{}`), echo.MIMEApplicationJSON, http.StatusBadRequest, codeFileRequired},
+		{"malformed", strings.NewReader("--x\r\nnot a part"), "multipart/form-data; boundary=x", http.StatusBadRequest, codeInvalidBody},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/items/1/images", tc.body)
+			req.Header.Set(echo.HeaderContentType, tc.contentType)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d, body = %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if tc.wantCode == "" {
+				return
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Code != tc.wantCode {
+				t.Errorf("body = %s, want code %s", rec.Body, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"jacket", "jacket"},
+		{"  jacket\t", "jacket"},
+		{"blue\tjacket", "blue jacket"},
+		{"blue\r\njacket\n", "blue  jacket"},
+		{"jack\x00et\x1b[31m", "jacket[31m"},
+		{"bad \xff utf-8", "bad  utf-8"},
+		{"ジャケット　Ｌ", "ジャケット　Ｌ"},
+		{"jacket 🧥", "jacket 🧥"},
+		{"family 👨\u200d👩\u200d👧", "family 👨\u200d👩\u200d👧"},
+		{"\n\t\x00", ""},
+	}
+	for _, tc := range cases {
+		if got := sanitizeName(tc.in); got != tc.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAddItemSanitizesName(t *testing.T) {
+	cases := []struct {
+		name       string
+		wantStatus int
+		wantName   string
+	}{
+		{"\tjacket\n", http.StatusCreated, "jacket"},
+		{"ジャケット 🧥", http.StatusCreated, "ジャケット 🧥"},
+		{"\x00\n", http.StatusBadRequest, ""},
+	}
+	for _, tc := range cases {
+		body, err := json.Marshal(AddItemRequest{Name: tc.name, Category: "fashion"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/items", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		newEcho(newTestServer(t)).ServeHTTP(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("name %q: status = %d, want %d", tc.name, rec.Code, tc.wantStatus)
+			continue
+		}
+		var item Item
+		if tc.wantStatus == http.StatusCreated {
+			json.Unmarshal(rec.Body.Bytes(), &item)
+			if item.Name != tc.wantName {
+				t.Errorf("name %q: stored as %q, want %q", tc.name, item.Name, tc.wantName)
+			}
+		}
+	}
+}
+
+// A missing items.json means no items, but one that cannot be read must stop
+// the boot rather than be taken for missing or corrupt.
+func TestOpenDBUnreadableItemsJSON(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		DBPath:         filepath.Join(dir, "mercari.sqlite3"),
+		ItemsJSON:      filepath.Join(dir, "items.json"),
+		DBMaxOpenConns: 1,
+	}
+	// Reading a directory fails even for root, unlike a file without
+	// read permission.
+	if err := os.Mkdir(cfg.ItemsJSON, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := openDB(cfg); err == nil {
+		db.Close()
+		t.Fatal("openDB succeeded with an unreadable items.json")
+	}
+	if _, err := os.Stat(cfg.ItemsJSON + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("items.json was set aside: %v", err)
+	}
+}
+
+func TestOpenDBCorruptItemsJSON(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := &Config{
+				DBPath:         filepath.Join(dir, "mercari.sqlite3"),
+				ItemsJSON:      filepath.Join(dir, "items.json"),
+				StrictData:     strict,
+				DBMaxOpenConns: 1,
+			}
+			const corrupt = `{"items":[{"name":"jacket"`
+			if err := os.WriteFile(cfg.ItemsJSON, []byte(corrupt), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := openDB(cfg)
+			if strict {
+				if err == nil {
+					db.Close()
+					t.Fatal("openDB succeeded with a corrupt items.json")
+				}
+				// The next boot must still try to import it.
+				if _, err := os.Stat(cfg.DBPath); err == nil {
+					db, err := sql.Open("sqlite3", cfg.DBPath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer db.Close()
+					var version int
+					if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != 0 {
+						t.Errorf("user_version = %d, %v after a failed import, want 0", version, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			data, err := os.ReadFile(cfg.ItemsJSON + ".bak")
+			if err != nil || string(data) != corrupt {
+				t.Errorf("backup = %q, %v, want the corrupt file", data, err)
+			}
+			if _, err := os.Stat(cfg.ItemsJSON); !os.IsNotExist(err) {
+				t.Errorf("items.json still exists: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddItemConcurrent(t *testing.T) {
+	s := newTestServer(t)
+
+	const n = 50
+	e := newEcho(s)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, newAddItemRequest(t, "jacket", "fashion", testImage))
+			if rec.Code != http.StatusCreated {
+				t.Errorf("status = %d, body = %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	items, _, err := selectItems(context.Background(), s.db, ItemQuery{Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Errorf("got %d items, want %d", len(items), n)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	s := newTestServer(t)
+	items := make([]*Item, 100)
+	for i := range items {
+		items[i] = &Item{Name: fmt.Sprintf("item %d", i), Category: "fashion"}
+	}
+	if err := insertItems(context.Background(), s.db, items, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	e := newEcho(s)
+
+	get := func(path string, acceptGzip bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptGzip {
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get("/api/v1/items?limit=200", false)
+	rec := get("/api/v1/items?limit=200", true)
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("decompressed body differs from uncompressed response")
+	}
+
+	if got := get("/api/v1/health", true).Header().Get(echo.HeaderContentEncoding); got != "" {
+		t.Errorf("small response Content-Encoding = %q, want none", got)
+	}
+	rec = get("/api/v1/image/default.jpg", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("image status = %d", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "" {
+		t.Errorf("image Content-Encoding = %q, want none", got)
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	s := newTestServer(t)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: fmt.Sprintf("item %d", i), Category: "fashion"}, AddOptions{}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, _, err := selectItems(context.Background(), s.db, ItemQuery{Limit: -1}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, err := countItems(context.Background(), s.db, ItemQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("got %d items, want %d", count, n)
+	}
+}
+
+func TestGetItemImage(t *testing.T) {
+	s := newTestServer(t)
+	e := newEcho(s)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, newAddItemRequest(t, "jacket", "fashion", testImage))
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: "no image", Category: "misc"}, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = get("/api/v1/items/1/image", "")
+	etag := `"` + strings.TrimSuffix(item.Image, ".jpg") + `"`
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testImage) || rec.Header().Get("ETag") != etag {
+		t.Errorf("status = %d, ETag = %q, want 200 with the image and ETag %s", rec.Code, rec.Header().Get("ETag"), etag)
+	}
+	if got := rec.Header().Get(echo.HeaderCacheControl); got != itemImageCacheControl {
+		t.Errorf("Cache-Control = %q, want %q", got, itemImageCacheControl)
+	}
+	if rec := get("/api/v1/items/1/image", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec := get("/api/v1/items/2/image", ""); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testImage) || rec.Header().Get("ETag") != "" {
+		t.Errorf("no image: status = %d, ETag = %q, want the default image uncached", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := get("/api/v1/items/3/image", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing item: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHeadImg(t *testing.T) {
+	s := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(s.cfg.ImgDir, "abc123.jpg"), testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newEcho(s))
+	t.Cleanup(ts.Close)
+
+	for _, name := range []string{"abc123.jpg", "missing.jpg"} {
+		get, err := http.Get(ts.URL + "/api/v1/image/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(get.Body)
+		get.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := http.Head(ts.URL + "/api/v1/image/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head.Body.Close()
+
+		if head.StatusCode != http.StatusOK {
+			t.Errorf("HEAD %s: status = %d, want %d", name, head.StatusCode, http.StatusOK)
+		}
+		if want := strconv.Itoa(len(body)); head.Header.Get(echo.HeaderContentLength) != want {
+			t.Errorf("HEAD %s: Content-Length = %q, want %q", name, head.Header.Get(echo.HeaderContentLength), want)
+		}
+		for _, h := range []string{echo.HeaderContentType, "ETag"} {
+			if head.Header.Get(h) != get.Header.Get(h) {
+				t.Errorf("HEAD %s: %s = %q, want %q as for GET", name, h, head.Header.Get(h), get.Header.Get(h))
+			}
+		}
+	}
+}
+
+func TestGetImgPathTraversal(t *testing.T) {
+	s := newTestServer(t)
+	// A file the handlers must never serve, next to the image directory.
+	secret := []byte("secret")
+	if err := os.WriteFile(filepath.Join(filepath.Dir(s.cfg.ImgDir), "secret.jpg"), secret, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{
+		"../secret.jpg",
+		`..\secret.jpg`,
+		"..%2fsecret.jpg",
+		"%2e%2e%2fsecret.jpg",
+		"%2E%2E%5Csecret.jpg",
+		"images/../../secret.jpg",
+		"/etc/passwd.jpg",
+		"..jpg",
+		"%zz.jpg",
+	}
+	handlers := map[string]echo.HandlerFunc{"image": s.getImg, "thumbnail": s.getThumbnail}
+	for handler, h := range handlers {
+		for _, name := range names {
+			t.Run(handler+" "+name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+				c.SetParamNames("imageFilename")
+				c.SetParamValues(name)
+
+				if err := h(c); err != nil {
+					handleError(err, c)
+				}
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+				}
+				if bytes.Contains(rec.Body.Bytes(), secret) {
+					t.Error("served a file outside the image directory")
+				}
+			})
+		}
+	}
+
+	e := newEcho(s)
+	for _, target := range []string{"/api/v1/image/..%2fsecret.jpg", "/api/v1/image/%2e%2e%2fsecret.jpg/thumbnail"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLegacyRedirect(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	cases := []struct {
+		method     string
+		target     string
+		wantStatus int
+		wantTarget string
+	}{
+		{http.MethodGet, "/items?limit=1", http.StatusMovedPermanently, "/api/v1/items?limit=1"},
+		{http.MethodGet, "/image/default.jpg/thumbnail", http.StatusMovedPermanently, "/api/v1/image/default.jpg/thumbnail"},
+		{http.MethodPost, "/items", http.StatusPermanentRedirect, "/api/v1/items"},
+		{http.MethodDelete, "/items/1", http.StatusPermanentRedirect, "/api/v1/items/1"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.target, rec.Code, tc.wantStatus)
+		}
+		if got := rec.Header().Get(echo.HeaderLocation); got != tc.wantTarget {
+			t.Errorf("%s %s: Location = %q, want %q", tc.method, tc.target, got, tc.wantTarget)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	e := newEcho(s)
+	cases := []struct {
+		method     string
+		target     string
+		user, pass string
+		wantStatus int
+	}{
+		{http.MethodGet, "/api/v1/items", "", "", http.StatusOK},
+		{http.MethodGet, "/api/v1/health", "", "", http.StatusOK},
+		{http.MethodDelete, "/api/v1/items/1", "", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/api/v1/items/1", "admin", "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, "/api/v1/items/1", "admin", "secret", http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s %s as %q: status = %d, want %d", tc.method, tc.target, tc.user, rec.Code, tc.wantStatus)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", tc.method, tc.target)
+		}
+	}
+}
+
+func TestDeleteItems(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	e := newEcho(s)
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, _, err := insertItemOnce(context.Background(), s.db, &Item{Name: fmt.Sprintf("item %d", i), Category: "fashion", Image: defaultImage}, AddOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	serve := func(body string, auth bool) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/items", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := fmt.Sprintf(`{"ids":[%d,%d,999]}`, ids[0], ids[1])
+	if rec := serve(body, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serve(`{"ids":[]}`, true); rec.Code != http.StatusBadRequest {
+		t.Errorf("no ids: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := serve(body, true)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"deleted":2}` {
+		t.Fatalf("status = %d, body = %s, want 200 with 2 deleted", rec.Code, rec.Body)
+	}
+	if rec := serve(body, true); strings.TrimSpace(rec.Body.String()) != `{"deleted":0}` {
+		t.Errorf("again: body = %s, want 0 deleted", rec.Body)
+	}
+	if _, err := selectItem(context.Background(), s.db, ids[2]); err != nil {
+		t.Errorf("item not in the request: %v", err)
+	}
+}
+
+// userToken logs in to e as username and returns the token issued.
+func userToken(t *testing.T, e *echo.Echo, username string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"username":"`+username+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var res LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Token == "" {
+		t.Fatalf("login as %s: status = %d, body = %s", username, rec.Code, rec.Body)
+	}
+	return res.Token
+}
+
+func TestItemOwnership(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.JWTSecret = "secret"
+	e := newEcho(s)
+	serve := func(method, target, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	alice, bob := userToken(t, e, "alice"), userToken(t, e, "bob")
+
+	if rec := serve(http.MethodPost, "/api/v1/items", "", `{"name":"jacket","category":"fashion"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("add without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := serve(http.MethodPost, "/api/v1/items", alice, `{"name":"jacket","category":"fashion"}`)
+	var item Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if item.OwnerID != "alice" {
+		t.Errorf("owner_id = %q, want alice", item.OwnerID)
+	}
+
+	target := fmt.Sprintf("/api/v1/items/%d", item.ID)
+	cases := []struct {
+		method     string
+		token      string
+		wantStatus int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodPatch, bob, http.StatusForbidden},
+		{http.MethodDelete, bob, http.StatusForbidden},
+		{http.MethodPatch, alice, http.StatusOK},
+		{http.MethodDelete, alice, http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		if rec := serve(tc.method, target, tc.token, `{"price":100}`); rec.Code != tc.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d, body = %s", tc.method, target, rec.Code, tc.wantStatus, rec.Body)
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	cases := []struct {
+		method     string
+		target     string
+		wantStatus int
+		wantCode   string
+	}{
+		{http.MethodGet, "/api/v1/nope", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodGet, "/nope", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodPut, "/api/v1/categories", http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.target, rec.Code, tc.wantStatus)
+		}
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Code != tc.wantCode || res.Message == "" {
+			t.Errorf("%s %s: body = %s, want JSON with code %s", tc.method, tc.target, rec.Body, tc.wantCode)
+		}
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/categories", nil))
+	if allow := rec.Header().Get(echo.HeaderAllow); !strings.Contains(allow, http.MethodGet) {
+		t.Errorf("Allow = %q, want it to list GET", allow)
+	}
+}
+
+func TestAccessLogAndMetrics(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	var logs bytes.Buffer
+	e.Logger.SetOutput(&logs)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/items/abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if want := `"status":400,`; !strings.Contains(logs.String(), want) {
+		t.Errorf("access log = %s, want %s", logs.String(), want)
+	}
+	if want := `"error":"Invalid ID format"`; !strings.Contains(logs.String(), want) {
+		t.Errorf("access log = %s, want %s", logs.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `http_requests_total{method="GET",route="/api/v1/items/:id",status="400"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics lack %s", want)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	var logs bytes.Buffer
+	e.Logger.SetOutput(&logs)
+	e.GET("/panic", func(c echo.Context) error {
+		panic("secret detail")
+	})
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+
+	res, err := http.Get(ts.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusInternalServerError)
+	}
+	var errRes ErrorResponse
+	if err := json.Unmarshal(body, &errRes); err != nil {
+		t.Fatal(err)
+	}
+	if errRes.Code != codeInternal || bytes.Contains(body, []byte("secret detail")) || bytes.Contains(body, []byte("goroutine")) {
+		t.Errorf("body = %s", body)
+	}
+
+	id := res.Header.Get(echo.HeaderXRequestID)
+	for _, want := range []string{id, "secret detail", "goroutine"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, logs.String())
+		}
+	}
+
+	res, err = http.Get(ts.URL + "/api/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status after panic = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	cases := []struct {
+		name    string
+		trusted string
+		want    []int
+	}{
+		// A client can't get a new bucket by changing the header.
+		{"untrusted", "", []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests}},
+		// httptest requests come from 192.0.2.1, so the header is believed.
+		{"trusted", "192.0.2.0/24", []int{http.StatusCreated, http.StatusCreated, http.StatusCreated}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tc.trusted)
+			s := newTestServer(t)
+			s.cfg.WriteRateLimit, s.cfg.WriteRateBurst = 1e-9, 2
+			e := newEcho(s)
+			for i, want := range tc.want {
+				req := newAddItemRequest(t, "jacket", "fashion", testImage)
+				req.Header.Set(echo.HeaderXForwardedFor, fmt.Sprintf("203.0.113.%d", i+1))
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("request %d: status = %d, want %d, body = %s", i+1, rec.Code, want, rec.Body)
+				}
+			}
+		})
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted TRUSTED_PROXIES without a prefix length")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "10ms")
+	e := newEcho(newTestServer(t))
+	e.Logger.SetOutput(io.Discard)
+	e.GET("/slow", func(c echo.Context) error {
+		<-c.Request().Context().Done()
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to select items", c.Request().Context().Err())
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusServiceUnavailable || res.Code != codeTimeout {
+		t.Errorf("status = %d, body = %s, want 503 %s", rec.Code, rec.Body, codeTimeout)
+	}
+
+	for path, want := range map[string]bool{
+		apiPrefix + "/items":                          false,
+		apiPrefix + "/items/stream":                   true,
+		apiPrefix + "/ws":                             true,
+		apiPrefix + "/items.csv":                      true,
+		apiPrefix + "/image/:imageFilename":           true,
+		apiPrefix + "/items/:id/image":                true,
+		apiPrefix + "/image/:imageFilename/thumbnail": false,
+	} {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.SetPath(path)
+		if got := longLived(c); got != want {
+			t.Errorf("longLived(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRequestTimeoutStopsRoutes(t *testing.T) {
+	// The deadline has passed by the time the handlers run, so the query
+	// and the thumbnail must give up rather than finish.
+	t.Setenv("REQUEST_TIMEOUT", "1ns")
+	s := newTestServer(t)
+	e := newEcho(s)
+	e.Logger.SetOutput(io.Discard)
+	for _, target := range []string{"/api/v1/items", "/api/v1/image/" + defaultImage + "/thumbnail"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusServiceUnavailable || res.Code != codeTimeout {
+			t.Errorf("%s: status = %d, body = %s, want 503 %s", target, rec.Code, rec.Body, codeTimeout)
+		}
+	}
+	if _, err := os.Stat(thumbnailPath(filepath.Join(s.cfg.ImgDir, defaultImage))); !os.IsNotExist(err) {
+		t.Errorf("thumbnail written after the deadline: %v", err)
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	got := parseAccept("text/html;q=0.5, application/XML ,, */*;q=0.5, ja-JP;q=bad")
+	want := []acceptValue{{"application/xml", 1}, {"ja-jp", 1}, {"text/html", 0.5}, {"*/*", 0.5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAccept = %v, want %v", got, want)
+	}
+	for header, want := range map[string]bool{"application/xml": true, "application/xml;q=0.9, */*": false, "": false} {
+		if got := prefersXML(header); got != want {
+			t.Errorf("prefersXML(%q) = %v, want %v", header, got, want)
+		}
+	}
+	for header, want := range map[string]string{"ja-JP": langJapanese, "ja;q=0.8, en;q=0.8": langEnglish, "fr": langEnglish} {
+		if got := preferredLanguage(header); got != want {
+			t.Errorf("preferredLanguage(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	cases := []struct {
+		acceptLanguage string
+		wantLang       string
+		wantMessage    string
+	}{
+		{"", langEnglish, "Invalid ID format"},
+		{"ja", langJapanese, "IDの形式が不正です"},
+		{"ja-JP,en;q=0.5", langJapanese, "IDの形式が不正です"},
+		{"en-US,ja;q=0.9", langEnglish, "Invalid ID format"},
+		{"ja;q=0.5,en;q=0.5", langEnglish, "Invalid ID format"},
+		{"ja;q=0", langEnglish, "Invalid ID format"},
+		{"fr", langEnglish, "Invalid ID format"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/items/abc", nil)
+		req.Header.Set("Accept-Language", tc.acceptLanguage)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != codeInvalidID || res.Message != tc.wantMessage {
+			t.Errorf("Accept-Language %q: error = %s %q, want %s %q", tc.acceptLanguage, res.Code, res.Message, codeInvalidID, tc.wantMessage)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tc.wantLang {
+			t.Errorf("Accept-Language %q: Content-Language = %q, want %q", tc.acceptLanguage, got, tc.wantLang)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Setenv("READ_ONLY", "true")
+	s := newTestServer(t)
+	s.cfg.AdminUser, s.cfg.AdminPass = "admin", "secret"
+	s.cfg.JWTSecret = "jwt-secret"
+	e := newEcho(s)
+	serveAs := func(method, target, body, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	admin := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		return serveAs(method, target, body, admin)
+	}
+
+	rec := serve(http.MethodPost, "/api/v1/items", `{"name":"jacket","category":"fashion"}`)
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusServiceUnavailable || res.Code != codeMaintenance {
+		t.Errorf("add: status = %d, body = %s, want 503 %s", rec.Code, rec.Body, codeMaintenance)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/items", ""); rec.Code != http.StatusOK {
+		t.Errorf("list: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	// Anyone can get a user token, so one must not switch the mode.
+	token := "Bearer " + userToken(t, e, "alice")
+	for name, auth := range map[string]string{"anonymous": "", "user": token} {
+		if rec := serveAs(http.MethodPut, "/api/v1/maintenance", `{"read_only":false}`, auth); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s toggle: status = %d, want %d", name, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if rec := serve(http.MethodPut, "/api/v1/maintenance", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty toggle: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	if rec := serve(http.MethodPut, "/api/v1/maintenance", `{"read_only":false}`); rec.Code != http.StatusOK {
+		t.Fatalf("toggle: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/maintenance", ""); rec.Body.String() != "{\"read_only\":false}\n" {
+		t.Errorf("mode = %s, want read_only false", rec.Body)
+	}
+	if rec := serve(http.MethodPost, "/api/v1/items", `{"name":"jacket","category":"fashion"}`); rec.Code != http.StatusCreated {
+		t.Errorf("add after toggle: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Without admin credentials, only READ_ONLY sets the mode.
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/maintenance", strings.NewReader(`{"read_only":false}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	newEcho(newTestServer(t)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("toggle without ADMIN_USER: status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	e := newEcho(newTestServer(t))
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/items", nil)
+	req.Header.Set(echo.HeaderOrigin, "http://localhost:3000")
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+	req.Header.Set(echo.HeaderAccessControlRequestHeaders, "Idempotency-Key")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowHeaders); !strings.Contains(got, "Idempotency-Key") {
+		t.Errorf("Access-Control-Allow-Headers = %q, want Idempotency-Key among them", got)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlMaxAge); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/items", nil)
+	req.Header.Set(echo.HeaderOrigin, "http://localhost:3000")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if got := rec.Header().Get(echo.HeaderAccessControlExposeHeaders); got != "Location,ETag" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want Location,ETag", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// vacuumQuietPeriod is how long after the last write request maintenance
+// waits before vacuuming, so that it does not compete with heavy writes.
+const vacuumQuietPeriod = time.Minute
+
+// MaintenanceMode is the body of GET and PUT /maintenance.
+type MaintenanceMode struct {
+	ReadOnly *bool `json:"read_only" validate:"required"`
+}
+
+// rejectReadOnly answers write requests with 503 while the server is in
+// read-only mode, so that data can be backed up or migrated without
+// racing writers.
+func (s *Server) rejectReadOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.readOnly.Load() {
+			return newAPIError(http.StatusServiceUnavailable, codeMaintenance, "The API is read-only for maintenance", nil)
+		}
+		return next(c)
+	}
+}
+
+func (s *Server) getMaintenance(c echo.Context) error {
+	readOnly := s.readOnly.Load()
+	return c.JSON(http.StatusOK, MaintenanceMode{ReadOnly: &readOnly})
+}
+
+// setMaintenance turns read-only mode on or off until the next restart,
+// which goes back to Config.ReadOnly.
+func (s *Server) setMaintenance(c echo.Context) error {
+	var req MaintenanceMode
+	if err := c.Bind(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid request body", nil)
+	}
+	if err := c.Validate(&req); err != nil {
+		return err
+	}
+	s.readOnly.Store(*req.ReadOnly)
+	c.Logger().Infoj(log.JSON{"maintenance": "read_only", "enabled": *req.ReadOnly})
+	return c.JSON(http.StatusOK, req)
+}
+
+// trackWrites records when the last write was made and drops the responses
+// cached before it. Failed requests changed nothing, so they are left out.
+func (s *Server) trackWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if responseStatus(c, err) < http.StatusBadRequest {
+			s.lastWrite.Store(time.Now().UnixNano())
+			s.itemsCache.invalidate()
+		}
+		return err
+	}
+}
+
+// runMaintenance vacuums the database every interval until ctx is done.
+func (s *Server) runMaintenance(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.vacuum(ctx, logger)
+		}
+	}
+}
+
+// vacuum runs vacuumDB unless the database is being written to, in which
+// case it waits for the next interval.
+func (s *Server) vacuum(ctx context.Context, logger echo.Logger) {
+	if time.Since(time.Unix(0, s.lastWrite.Load())) < vacuumQuietPeriod {
+		logger.Debug("skipping vacuum: recent writes")
+		return
+	}
+	// Holding itemsMu keeps requests from waiting on SQLite's lock instead.
+	if !itemsMu.TryLock() {
+		logger.Debug("skipping vacuum: write in progress")
+		return
+	}
+	defer itemsMu.Unlock()
+
+	start := time.Now()
+	full, err := vacuumDB(ctx, s.db)
+	if err != nil {
+		logger.Errorj(log.JSON{"maintenance": "vacuum", "error": err.Error()})
+		return
+	}
+	logger.Infoj(log.JSON{"maintenance": "vacuum", "full": full, "duration": time.Since(start).String()})
+}
@@ -0,0 +1,78 @@
+package main
+
+import "strings"
+
+// Languages error messages are sent in. English is the language of the
+// messages written by the handlers, and the default.
+const (
+	langEnglish  = "en"
+	langJapanese = "ja"
+)
+
+// translations maps error codes to their message in languages other than
+// English. A translation is less specific than the English message it
+// replaces, which may name the field or value at fault, so clients that
+// need the details should ask for English.
+var translations = map[string]map[string]string{
+	codeInvalidQuery:      {langJapanese: "クエリパラメータが不正です"},
+	codeInvalidBody:       {langJapanese: "リクエストボディが不正です"},
+	codeInvalidCSV:        {langJapanese: "CSVファイルが不正です"},
+	codeInvalidID:         {langJapanese: "IDの形式が不正です"},
+	codeInvalidImageName:  {langJapanese: "画像ファイル名が不正です"},
+	codeFileRequired:      {langJapanese: "画像ファイルが必要です"},
+	codeUnsupportedImage:  {langJapanese: "画像はJPEG、PNG、WebPのいずれかの形式にしてください"},
+	codeInvalidImage:      {langJapanese: "画像ファイルが壊れています"},
+	codeImageDimensions:   {langJapanese: "画像の縦横のサイズが許容範囲外です"},
+	codeImageTooLarge:     {langJapanese: "画像ファイルが大きすぎます"},
+	codeValidationFailed:  {langJapanese: "入力内容に誤りがあります"},
+	codeDuplicateItem:     {langJapanese: "同じ商品がすでに登録されています"},
+	codeDuplicateName:     {langJapanese: "同じ名前の商品がすでに登録されています"},
+	codeDuplicateCategory: {langJapanese: "同じ名前のカテゴリがすでに存在します"},
+	codeForbidden:         {langJapanese: "この操作は許可されていません"},
+	codeQuotaExceeded:     {langJapanese: "登録できる商品数の上限に達しました"},
+	codeVersionConflict:   {langJapanese: "商品は他のリクエストによって更新されています"},
+	codeItemNotFound:      {langJapanese: "商品が見つかりません"},
+	codeImageNotFound:     {langJapanese: "画像が見つかりません"},
+	codeCategoryNotFound:  {langJapanese: "カテゴリが見つかりません"},
+	codeTimeout:           {langJapanese: "リクエストがタイムアウトしました"},
+	codeMaintenance:       {langJapanese: "メンテナンス中のため、現在は閲覧のみ可能です"},
+	codeInternal:          {langJapanese: "サーバー内部でエラーが発生しました"},
+
+	// Codes of the errors from Echo and its middleware.
+	"BAD_REQUEST":              {langJapanese: "リクエストが不正です"},
+	"UNAUTHORIZED":             {langJapanese: "認証が必要です"},
+	"NOT_FOUND":                {langJapanese: "ページが見つかりません"},
+	"METHOD_NOT_ALLOWED":       {langJapanese: "許可されていないメソッドです"},
+	"REQUEST_ENTITY_TOO_LARGE": {langJapanese: "リクエストが大きすぎます"},
+	"TOO_MANY_REQUESTS":        {langJapanese: "リクエストが多すぎます。しばらくしてから再度お試しください"},
+	"SERVICE_UNAVAILABLE":      {langJapanese: "サービスを一時的に利用できません"},
+}
+
+// localize returns res with its message in lang, or as is if there is no
+// translation. The code never changes.
+func localize(res ErrorResponse, lang string) ErrorResponse {
+	if message, ok := translations[res.Code][lang]; ok {
+		res.Message = message
+	}
+	return res
+}
+
+// preferredLanguage returns the language an Accept-Language header ranks
+// highest among those messages are sent in. English wins ties, as well as
+// headers accepting none of them.
+func preferredLanguage(acceptLanguage string) string {
+	best, bestQ := langEnglish, 0.0
+	for _, v := range parseAccept(acceptLanguage) {
+		// Only the primary subtag matters, so ja-JP counts as ja.
+		lang, _, _ := strings.Cut(v.value, "-")
+		switch lang {
+		case langEnglish, langJapanese:
+		default:
+			continue
+		}
+		if v.q > bestQ || v.q == bestQ && lang == langEnglish {
+			best, bestQ = lang, v.q
+		}
+	}
+	return best
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// itemSchemaJSON is the JSON Schema every item of a bulk request or CSV
+// import must match. It is served at /schemas/item.json for integrators.
+//
+//go:embed item.schema.json
+var itemSchemaJSON []byte
+
+var itemSchema = compileItemSchema()
+
+func compileItemSchema() *jsonschema.Schema {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	if err := c.AddResource("item.schema.json", bytes.NewReader(itemSchemaJSON)); err != nil {
+		panic(err)
+	}
+	return c.MustCompile("item.schema.json")
+}
+
+func getItemSchema(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/schema+json", itemSchemaJSON)
+}
+
+// validateItemJSON sanitizes the item in raw, checks it against itemSchema
+// and decodes it. A non-nil []FieldError reports why raw was rejected.
+func validateItemJSON(raw json.RawMessage) (*AddItemRequest, []FieldError, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, nil, err
+	}
+	if fields, ok := v.(map[string]any); ok {
+		sanitizeItemFields(fields)
+	}
+	if errs, err := validateItemValue(v); errs != nil || err != nil {
+		return nil, errs, err
+	}
+	// Decode the sanitized fields rather than raw.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req AddItemRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, nil, err
+	}
+	return &req, nil, nil
+}
+
+// sanitizeItemFields applies AddItemRequest.sanitize to a decoded item.
+func sanitizeItemFields(fields map[string]any) {
+	for key, clean := range map[string]func(string) string{
+		"name":        sanitizeName,
+		"category":    sanitizeName,
+		"description": sanitizeText,
+	} {
+		if s, ok := fields[key].(string); ok {
+			fields[key] = clean(s)
+		}
+	}
+}
+
+// validateItemValue checks a decoded JSON value against itemSchema.
+func validateItemValue(v any) ([]FieldError, error) {
+	err := itemSchema.Validate(v)
+	var verr *jsonschema.ValidationError
+	if errors.As(err, &verr) {
+		return schemaErrors(verr), nil
+	}
+	return nil, err
+}
+
+// schemaErrors flattens the causes of verr into FieldErrors sorted by
+// field, named as in the request.
+func schemaErrors(verr *jsonschema.ValidationError) []FieldError {
+	var errs []FieldError
+	for _, e := range verr.BasicOutput().Errors {
+		// The first unit is the summary of its causes.
+		if e.KeywordLocation == "" {
+			continue
+		}
+		field := strings.ReplaceAll(strings.TrimPrefix(e.InstanceLocation, "/"), "/", ".")
+		keyword := e.KeywordLocation[strings.LastIndex(e.KeywordLocation, "/")+1:]
+		switch keyword {
+		case "required":
+			// These name the fields in the message rather than the
+			// location, which is the enclosing object.
+			for _, name := range quotedNames(e.Error) {
+				errs = append(errs, FieldError{Field: name, Message: fmt.Sprintf("%s is required", name)})
+			}
+		case "additionalProperties":
+			for _, name := range quotedNames(e.Error) {
+				errs = append(errs, FieldError{Field: name, Message: fmt.Sprintf("%s is not a known field", name)})
+			}
+		case "pattern":
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("%s is required", field)})
+		default:
+			message := e.Error
+			if field != "" {
+				message = field + ": " + message
+			}
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+	}
+	// The causes come in no particular order.
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// quotedNames returns the 'quoted' names in a jsonschema error message.
+func quotedNames(message string) []string {
+	parts := strings.Split(message, "'")
+	var names []string
+	for i := 1; i < len(parts); i += 2 {
+		names = append(names, parts[i])
+	}
+	return names
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// statsTTL is how long GET /stats serves the same figures before computing
+// them again.
+const statsTTL = 10 * time.Second
+
+// Stats summarizes the catalog. Deleted items are not counted.
+type Stats struct {
+	TotalItems      int         `json:"total_items"`
+	TotalCategories int         `json:"total_categories"`
+	Categories      []*Category `json:"categories"`
+	// LatestItemAt is when the newest item was added, or nil if there are
+	// no items.
+	LatestItemAt *time.Time `json:"latest_item_at"`
+}
+
+// statsCache holds the Stats last computed and until when to serve them.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *Stats
+	expires time.Time
+}
+
+// selectStats computes the Stats in one read so the figures agree.
+func selectStats(ctx context.Context, db *sql.DB) (*Stats, error) {
+	itemsMu.RLock()
+	defer itemsMu.RUnlock()
+
+	var (
+		stats  Stats
+		latest sql.NullString
+	)
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), MAX(created_at) FROM items WHERE "+notDeleted).Scan(&stats.TotalItems, &latest)
+	if err != nil {
+		return nil, err
+	}
+	if latest.Valid {
+		t, err := parseTime(latest.String)
+		if err != nil {
+			return nil, err
+		}
+		stats.LatestItemAt = &t
+	}
+	if stats.Categories, err = queryCategories(ctx, db); err != nil {
+		return nil, err
+	}
+	stats.TotalCategories = len(stats.Categories)
+	return &stats, nil
+}
+
+func (s *Server) getStats(c echo.Context) error {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+
+	if s.stats.stats == nil || !time.Now().Before(s.stats.expires) {
+		stats, err := selectStats(c.Request().Context(), s.db)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to compute stats", err)
+		}
+		s.stats.stats, s.stats.expires = stats, time.Now().Add(statsTTL)
+	}
+	return c.JSON(http.StatusOK, s.stats.stats)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Values of Config.StorageBackend.
+const (
+	storageSQLite = "sqlite"
+	storageJSON   = "json"
+)
+
+// ItemStore stores the items served by the core item routes. Lookups of an
+// id with no item return sql.ErrNoRows whatever the backend. The ctx of a
+// request bounds its queries; the json backend, which only ever waits on
+// its own lock, ignores it.
+//
+// Routes needing more than this, such as bulk inserts, extra images and
+// the audit log, use the SQLite database directly and are only served by
+// the sqlite backend.
+type ItemStore interface {
+	// GetAll returns the page of items selected by q and the number of
+	// items matching its filters regardless of pagination.
+	GetAll(ctx context.Context, q ItemQuery) (items []*Item, total int, err error)
+	// Count returns the number of items matching the filters of q.
+	Count(ctx context.Context, q ItemQuery) (int, error)
+	GetByID(ctx context.Context, id int64) (*Item, error)
+	// GetByIDs returns the items with the given ids in the same order,
+	// skipping ids with no item.
+	GetByIDs(ctx context.Context, ids []int64) ([]*Item, error)
+	// Add stores item and returns its new id, setting its other generated
+	// fields, within the options described by AddOptions.
+	Add(ctx context.Context, item *Item, opts AddOptions) (id int64, replayed bool, err error)
+	// Update stores the user-editable fields of item, including its
+	// primary image, and sets item.Version to its new version. It returns
+	// errVersionConflict when version is non-zero and not the version of
+	// the stored item.
+	Update(ctx context.Context, item *Item, version int, actor string) error
+	// Delete deletes the item and returns the names of the images no item
+	// uses any more.
+	Delete(ctx context.Context, id int64, actor string) (orphans []string, err error)
+	// Search returns the items matching keyword and the filters of q.
+	Search(ctx context.Context, keyword string, q ItemQuery) ([]*Item, error)
+	// Owner returns the owner_id of the item, deleted or not, or "" if it
+	// has none.
+	Owner(ctx context.Context, id int64) (string, error)
+	// ImageInUse reports whether any item refers to the image.
+	ImageInUse(ctx context.Context, name string) (bool, error)
+	// IdempotentItemID returns the id of the item added with the
+	// idempotency key since the given time, or sql.ErrNoRows.
+	IdempotentItemID(ctx context.Context, key string, since time.Time) (int64, error)
+	// Ping reports whether the store can serve requests.
+	Ping(ctx context.Context) error
+}
+
+// AddOptions are the checks made by ItemStore.Add. If Key, the idempotency
+// key of the request, was used since Since, nothing is added and the id
+// of the earlier item is returned with replayed set. With Dedup, an item
+// with the same name and category as another is not added either and a
+// *duplicateItemError is returned. Nor is one that would make more than
+// MaxItems, if positive, and errQuotaExceeded is returned. Actor is
+// recorded in the audit log. BeforeCommit, if set, is called once the item
+// passed the checks, right before it is committed; an error from it
+// aborts the insert.
+type AddOptions struct {
+	Key          string
+	Since        time.Time
+	Dedup        bool
+	MaxItems     int
+	Actor        string
+	BeforeCommit func() error
+}
+
+// SQLiteStore is the ItemStore of the sqlite backend.
+type SQLiteStore struct {
+	db *sql.DB
+	// softDelete makes Delete hide items so they can be restored.
+	softDelete bool
+}
+
+func (s *SQLiteStore) GetAll(ctx context.Context, q ItemQuery) ([]*Item, int, error) {
+	return selectItems(ctx, s.db, q)
+}
+
+func (s *SQLiteStore) Count(ctx context.Context, q ItemQuery) (int, error) {
+	return countItems(ctx, s.db, q)
+}
+
+func (s *SQLiteStore) GetByID(ctx context.Context, id int64) (*Item, error) {
+	return selectItem(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) GetByIDs(ctx context.Context, ids []int64) ([]*Item, error) {
+	return selectItemsByID(ctx, s.db, ids)
+}
+
+func (s *SQLiteStore) Add(ctx context.Context, item *Item, opts AddOptions) (int64, bool, error) {
+	return insertItemOnce(ctx, s.db, item, opts)
+}
+
+func (s *SQLiteStore) Update(ctx context.Context, item *Item, version int, actor string) error {
+	return updateItemByID(ctx, s.db, item, version, actor)
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, id int64, actor string) ([]string, error) {
+	if s.softDelete {
+		// The images stay, as the item can come back.
+		return nil, softDeleteItemByID(ctx, s.db, id, actor)
+	}
+	return deleteItemByID(ctx, s.db, id, actor)
+}
+
+func (s *SQLiteStore) Search(ctx context.Context, keyword string, q ItemQuery) ([]*Item, error) {
+	return searchItems(ctx, s.db, keyword, q)
+}
+
+func (s *SQLiteStore) Owner(ctx context.Context, id int64) (string, error) {
+	return selectItemOwner(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) ImageInUse(ctx context.Context, name string) (bool, error) {
+	return imageInUse(ctx, s.db, name)
+}
+
+func (s *SQLiteStore) IdempotentItemID(ctx context.Context, key string, since time.Time) (int64, error) {
+	return selectIdempotentItemID(ctx, s.db, key, since)
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// AddItemRequest holds the user-supplied fields of a new item, from either
+// a form or a JSON body.
+type AddItemRequest struct {
+	Name        string `json:"name" form:"name" validate:"notblank,maxname"`
+	Category    string `json:"category" form:"category" validate:"notblank,maxname"`
+	Price       int    `json:"price" form:"price" validate:"min=0"` // in yen
+	Description string `json:"description" form:"description"`
+	// AltText describes the image and defaults to Name.
+	AltText string `json:"alt_text" form:"alt_text" validate:"maxname"`
+}
+
+// requestForItem returns the request that would create item, so items
+// changed by other means are validated by the same rules.
+func requestForItem(item *Item) *AddItemRequest {
+	return &AddItemRequest{
+		Name:        item.Name,
+		Category:    item.Category,
+		Price:       item.Price,
+		Description: item.Description,
+		AltText:     item.AltText,
+	}
+}
+
+// sanitize cleans up the text fields before they are validated.
+func (r *AddItemRequest) sanitize() {
+	r.Name = sanitizeName(r.Name)
+	r.Category = sanitizeName(r.Category)
+	r.Description = sanitizeText(r.Description)
+	r.AltText = sanitizeName(r.AltText)
+}
+
+func (r *AddItemRequest) item() *Item {
+	return &Item{
+		Name:        r.Name,
+		Category:    r.Category,
+		Price:       r.Price,
+		Description: r.Description,
+		AltText:     r.AltText,
+	}
+}
+
+// RenameCategoryRequest is the body of PUT /categories/:id.
+type RenameCategoryRequest struct {
+	Name string `json:"name" form:"name" validate:"notblank,maxname"`
+}
+
+// ItemImageRequest is the fields sent along an image added to an item.
+type ItemImageRequest struct {
+	// AltText describes the image and defaults to the name of the item.
+	AltText string `json:"alt_text" form:"alt_text" validate:"maxname"`
+}
+
+// PatchItemRequest is the body of a PATCH, JSON or a multipart form with
+// a new image. A nil field was absent or null and is left unchanged.
+type PatchItemRequest struct {
+	Name        *string `json:"name" form:"name"`
+	Category    *string `json:"category" form:"category"`
+	Price       *int    `json:"price" form:"price"` // in yen
+	Description *string `json:"description" form:"description"`
+	AltText     *string `json:"alt_text" form:"alt_text"`
+	// Version, if set, is the version of the item the changes are based
+	// on. It is not a field to update.
+	Version *int `json:"version" form:"version"`
+}
+
+func (r *PatchItemRequest) empty() bool {
+	return r.Name == nil && r.Category == nil && r.Price == nil && r.Description == nil && r.AltText == nil
+}
+
+// apply sets the fields of item present in r. The result still needs to be
+// validated.
+func (r *PatchItemRequest) apply(item *Item) {
+	if r.Name != nil {
+		item.Name = *r.Name
+	}
+	if r.Category != nil {
+		item.Category = *r.Category
+	}
+	if r.Price != nil {
+		item.Price = *r.Price
+	}
+	if r.Description != nil {
+		item.Description = *r.Description
+	}
+	if r.AltText != nil {
+		item.AltText = *r.AltText
+	}
+}
+
+// FieldError describes why one field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// maxNameLength is the most characters of the names and categories of
+// items, checked by the maxname validation.
+const maxNameLength = 255
+
+// Validator implements echo.Validator with go-playground/validator.
+type Validator struct {
+	v *validator.Validate
+}
+
+func newValidator() *Validator {
+	v := validator.New()
+	// Report fields by the name clients send them as.
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	// Tags cannot refer to constants, so the limit comes in by alias.
+	v.RegisterAlias("maxname", fmt.Sprintf("max=%d", maxNameLength))
+	// required accepts whitespace, which is no more a name than "" is.
+	v.RegisterValidation("notblank", func(fl validator.FieldLevel) bool {
+		return strings.TrimSpace(fl.Field().String()) != ""
+	})
+	return &Validator{v: v}
+}
+
+// sanitizer is implemented by requests whose fields need cleaning up
+// before they are validated.
+type sanitizer interface {
+	sanitize()
+}
+
+// Validate validates i, sanitizing it first if it implements sanitizer.
+func (v *Validator) Validate(i any) error {
+	if s, ok := i.(sanitizer); ok {
+		s.sanitize()
+	}
+	return v.v.Struct(i)
+}
+
+// sanitizeName makes s safe to display on one line and in CSV exports:
+// tabs and line breaks become a space, other control characters and
+// invalid UTF-8 are dropped and the result is trimmed. Letters of any
+// script, full-width spaces and emoji are kept.
+func sanitizeName(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r) && unicode.IsSpace(r), unicode.In(r, unicode.Zl, unicode.Zp):
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, "")))
+}
+
+// sanitizeText is like sanitizeName for free text, which keeps its line
+// breaks and tabs.
+func sanitizeText(s string) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\r\n", "\n")
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// fieldErrors converts the error of Validator.Validate into messages
+// suitable for the client. It returns nil if err is not a validation error.
+func fieldErrors(err error) []FieldError {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil
+	}
+	res := make([]FieldError, len(verrs))
+	for i, fe := range verrs {
+		res[i] = FieldError{Field: fe.Field(), Message: fieldErrorMessage(fe)}
+	}
+	return res
+}
+
+func fieldErrorMessage(fe validator.FieldError) string {
+	// ActualTag sees through aliases such as maxname.
+	switch fe.ActualTag() {
+	case "required", "notblank":
+		return fmt.Sprintf("%s is required", fe.Field())
+	case "max":
+		return fmt.Sprintf("%s must be at most %s characters", fe.Field(), fe.Param())
+	case "min":
+		return fmt.Sprintf("%s must be a non-negative integer", fe.Field())
+	}
+	return fmt.Sprintf("%s is invalid", fe.Field())
+}
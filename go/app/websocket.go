@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// wsWriteTimeout bounds each write to a WebSocket client.
+	wsWriteTimeout = 10 * time.Second
+	// wsPongTimeout is how long a client may go without answering a ping
+	// before it is considered gone. Pings are sent more often than that.
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+)
+
+// watchItems upgrades the request to a WebSocket and sends an ItemEvent as
+// a JSON text message for every item added until the client disconnects.
+func (s *Server) watchItems(c echo.Context) error {
+	// Subscribe first so the client misses nothing added once the
+	// handshake completes.
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		c.Logger().Debugf("WebSocket upgrade failed: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	// Clients only ever send control frames, but reading is what processes
+	// them and notices the connection closing.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(ev); err != nil {
+				return nil
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return nil
+			}
+		case <-gone:
+			return nil
+		}
+	}
+}
+
+// checkOrigin accepts the WebSocket handshakes CORS would accept, and
+// those of non-browser clients, which send no Origin.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.cfg.FrontURLs {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	// Like gorilla/websocket's default, allow pages of the API's own host.
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}